@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// Maximum amount of audio to queue before WriteSamples waits, in bytes
+const maxQueuedAudio = SAMPLE_RATE * 2 / 10 // 100ms
+
+// SDLAudio plays audio samples through SDL
+type SDLAudio struct {
+	dev sdl.AudioDeviceID
+}
+
+// OpenSDLAudio initialises SDL audio & opens the default audio device
+func OpenSDLAudio() (*SDLAudio, error) {
+	err := sdl.InitSubSystem(sdl.INIT_AUDIO)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &sdl.AudioSpec{
+		Freq:     SAMPLE_RATE,
+		Format:   sdl.AUDIO_S16LSB,
+		Channels: 1,
+		Samples:  soundBufferSize,
+	}
+	dev, err := sdl.OpenAudioDevice("", false, spec, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	sdl.PauseAudioDevice(dev, false)
+
+	return &SDLAudio{
+		dev: dev,
+	}, nil
+}
+
+// WriteSamples queues samples for playback. The emulator runs faster than a
+// real PET, so this waits for the queue to drain which keeps the emulation in
+// step with the audio.
+func (a *SDLAudio) WriteSamples(samples []int16) error {
+	data := make([]byte, len(samples)*2)
+	for n, s := range samples {
+		binary.LittleEndian.PutUint16(data[n*2:], uint16(s))
+	}
+
+	for sdl.GetQueuedAudioSize(a.dev) > maxQueuedAudio {
+		sdl.Delay(1)
+	}
+	return sdl.QueueAudio(a.dev, data)
+}
+
+func (a *SDLAudio) Close() {
+	sdl.CloseAudioDevice(a.dev)
+	sdl.QuitSubSystem(sdl.INIT_AUDIO)
+}
@@ -0,0 +1,102 @@
+package main
+
+const (
+	// Control register
+	BANK_CONTROL = 0xfff0
+
+	// Control register bits
+	BANK_WP_LO     = 0x01 // Write protect $8000-$bfff
+	BANK_WP_HI     = 0x02 // Write protect $c000-$ffff
+	BANK_SELECT_LO = 0x04 // Bank select for $8000-$bfff (0 = bank 0, 1 = bank 1)
+	BANK_SELECT_HI = 0x08 // Bank select for $c000-$ffff (0 = bank 2, 1 = bank 3)
+	BANK_PEEK_SCR  = 0x20 // Screen peek-through ($8000-$8fff)
+	BANK_PEEK_IO   = 0x40 // I/O peek-through ($e800-$efff)
+	BANK_ENABLE    = 0x80 // Enable expansion RAM
+
+	BANK_SIZE = 0x4000 // 16k per bank
+)
+
+/*
+BankedRAM models the 8096 (and 8296) 64k RAM expansion. The expansion is four
+16k banks, two of which are mapped over $8000-$ffff when enabled by the control
+register at $fff0. The screen memory & I/O can "peek through" the expansion
+RAM, otherwise the expansion replaces the screen memory, I/O & ROMs.
+*/
+type BankedRAM struct {
+	Base Word // Base address
+	Size Word // Size of the mapped window
+
+	control Byte // Control register
+	mem     []Byte
+}
+
+func (r *BankedRAM) GetBase() Word {
+	return r.Base
+}
+
+func (r *BankedRAM) GetSize() Word {
+	return r.Size
+}
+
+func (r *BankedRAM) CheckInterrupt() bool {
+	return false
+}
+
+func (r *BankedRAM) Reset() {
+	r.control = 0x00
+	r.mem = make([]Byte, 4*BANK_SIZE)
+}
+
+// Selected returns true if the expansion RAM is mapped at the address
+func (r *BankedRAM) Selected(address Word, write bool) bool {
+	// The control register is always write-only
+	if write && address == BANK_CONTROL {
+		return true
+	}
+
+	if r.control&BANK_ENABLE == 0 {
+		return false
+	}
+	if r.control&BANK_PEEK_SCR != 0 && address >= 0x8000 && address <= 0x8fff {
+		return false
+	}
+	if r.control&BANK_PEEK_IO != 0 && address >= 0xe800 && address <= 0xefff {
+		return false
+	}
+	return true
+}
+
+// offset returns the offset into the expansion RAM for the address
+func (r *BankedRAM) offset(address Word) int {
+	bank := 0
+	if address >= 0xc000 {
+		bank = 2
+		if r.control&BANK_SELECT_HI != 0 {
+			bank = 3
+		}
+	} else if r.control&BANK_SELECT_LO != 0 {
+		bank = 1
+	}
+	return bank*BANK_SIZE + int(address&(BANK_SIZE-1))
+}
+
+func (r *BankedRAM) Read(address Word) Byte {
+	return r.mem[r.offset(address)]
+}
+
+func (r *BankedRAM) Write(address Word, data Byte) {
+	if address == BANK_CONTROL {
+		r.control = data
+		return
+	}
+
+	// Check for write protection
+	if address >= 0xc000 {
+		if r.control&BANK_WP_HI != 0 {
+			return
+		}
+	} else if r.control&BANK_WP_LO != 0 {
+		return
+	}
+	r.mem[r.offset(address)] = data
+}
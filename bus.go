@@ -14,6 +14,30 @@ type Device interface {
 	mos6502.ReadWriter
 }
 
+// Switchable is implemented by devices whose mapping can change at run time.
+// The bus skips a Switchable device unless it is selected for the address.
+type Switchable interface {
+	Selected(address Word, write bool) bool
+}
+
+// selected returns true if the device should handle the access to address
+func selected(d Device, address Word, write bool) bool {
+	base := d.GetBase()
+	top := base + (d.GetSize() - 1)
+	if address < base || address > top {
+		return false
+	}
+	if s, ok := d.(Switchable); ok {
+		return s.Selected(address, write)
+	}
+	return true
+}
+
+// Ticker is implemented by devices which are driven by the system clock
+type Ticker interface {
+	Tick(cycles int)
+}
+
 type Bus struct {
 	Devices []Device
 
@@ -37,14 +61,8 @@ func (b *Bus) Read(address Word) Byte {
 	b.debug("read $%04x\n", address)
 
 	for n, d := range b.Devices {
-		base := d.GetBase()
-		size := d.GetSize()
-		top := base + (size - 1)
-
-		b.debug("device %d at $%04x:$%04x\n", n, base, base+top)
-
-		if address >= base && address <= top {
-			b.debug("selected device %d at $%04x\n", n, base)
+		if selected(d, address, false) {
+			b.debug("selected device %d at $%04x\n", n, d.GetBase())
 			return d.Read(address)
 		}
 	}
@@ -55,14 +73,10 @@ func (b *Bus) Write(address Word, data Byte) {
 	b.debug("write $%04x\n", address)
 
 	for n, d := range b.Devices {
-		base := d.GetBase()
-		size := d.GetSize()
-		top := base + (size - 1)
-
-		b.debug("device %d at $%04x:$%04x\n", n, base, base+top)
-		if address >= base && address <= top {
-			b.debug("selected device %d at $%04x\n", n, base)
+		if selected(d, address, true) {
+			b.debug("selected device %d at $%04x\n", n, d.GetBase())
 			d.Write(address, data)
+			return
 		}
 	}
 }
@@ -76,3 +90,12 @@ func (b *Bus) CheckInterrupts() bool {
 	}
 	return false
 }
+
+// Tick advances all of the clocked devices by the given number of cycles
+func (b *Bus) Tick(cycles int) {
+	for _, d := range b.Devices {
+		if t, ok := d.(Ticker); ok {
+			t.Tick(cycles)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Character set of every PET model, & the one which is built in
+const CHARSET_US = "us"
+
+// Size of a character generator ROM: two sets of 128 characters, 8 bytes each
+const CHARSET_SIZE = 0x800
+
+/*
+Character generator ROMs, by name. Only the standard US ROM is built in. The
+German, Swedish & Japanese (katakana) sets, & any custom font, are loaded from
+their ROM image, given as a filename.
+*/
+var charsets = map[string]string{
+	CHARSET_US: "char-901447-10.bin",
+}
+
+// Character sets fitted to each model. The 40 & 80 column models all have the
+// 901447-10 character generator.
+var modelCharsets = map[string]string{
+	"2001": CHARSET_US,
+	"4016": CHARSET_US,
+	"4032": CHARSET_US,
+	"8032": CHARSET_US,
+	"8096": CHARSET_US,
+	"8296": CHARSET_US,
+}
+
+// modelCharset returns the character set of the model with the given number
+// of screen columns
+func modelCharset(columns int) string {
+	if columns == 80 {
+		return modelCharsets["8032"]
+	}
+	return modelCharsets["4032"]
+}
+
+// charsetNames returns the names of the known character sets & models, for
+// help text
+func charsetNames() string {
+	var names []string
+	for name := range charsets {
+		names = append(names, name)
+	}
+	for name := range modelCharsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+/*
+LoadCharset loads a character set, given by name E.g. "us", by model E.g.
+"8032" or as the filename of a ROM image, into a new ROM. The ROM is never
+changed once it has been loaded, as the GUI draws with it while the CPU runs,
+so a character set is reloaded by loading a new ROM & handing that to the
+video.
+*/
+func LoadCharset(roms *ROMSet, name string) (*ROM, error) {
+	key := strings.ToLower(name)
+	if model, ok := modelCharsets[key]; ok {
+		key = model
+	}
+	filename := name
+	if f, ok := charsets[key]; ok {
+		filename = f
+	}
+
+	rom := &ROM{
+		Size: CHARSET_SIZE,
+	}
+	rom.Reset()
+	err := roms.Load(rom, filename)
+	if err != nil {
+		return nil, err
+	}
+	return rom, nil
+}
+
+// LoadModelCharset loads the character set given by name, or if name is empty
+// the set of the model with the given number of screen columns
+func LoadModelCharset(roms *ROMSet, name string, columns int) (*ROM, error) {
+	if name == "" {
+		name = modelCharset(columns)
+	}
+	return LoadCharset(roms, name)
+}
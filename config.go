@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultConfig returns the path to the default configuration file, if it
+// exists
+func defaultConfig() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	filename := filepath.Join(dir, "pet", "pet.conf")
+	_, err = os.Stat(filename)
+	if err != nil {
+		return ""
+	}
+	return filename
+}
+
+/*
+loadConfig sets flags from a configuration file. Each line of the file is a
+"name = value" pair, where name is the name of a command line flag E.g.
+
+	# Business PET with a toolkit
+	r = 4
+	c = 80
+	rom9 = /home/pet/roms/toolkit.bin
+
+Blank lines & lines starting with # are ignored. Flags that were given on the
+command line are not changed.
+*/
+func loadConfig(filename string, flags *flag.FlagSet) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Find the flags which were set on the command line
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", filename, n)
+		}
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+
+		if flags.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown option %q", filename, n, name)
+		}
+		if set[name] {
+			continue
+		}
+
+		err = flags.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, n, err)
+		}
+	}
+	return scanner.Err()
+}
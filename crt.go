@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Phosphor colours of the monitors fitted to PETs, by name
+var phosphors = map[string]color.RGBA{
+	"green": {0x33, 0xff, 0x33, 0xff}, // P1, fitted to most PETs
+	"white": {0xe8, 0xf0, 0xff, 0xff}, // P4, fitted to the 2001
+	"amber": {0xff, 0xb0, 0x00, 0xff}, // P3, fitted to replacement monitors
+}
+
+// Default CRT settings
+const (
+	CRT_PHOSPHOR     = "green"
+	CRT_BLOOM_RADIUS = 2         // Distance the glow spreads, in framebuffer pixels
+	CRT_GLOW_MIN     = 1.0 / 255 // Afterglow dimmer than this is black
+)
+
+// ParsePhosphor returns the colour of a phosphor given by name E.g. "amber",
+// or as an RGB colour E.g. "#ffb000"
+func ParsePhosphor(name string) (color.RGBA, error) {
+	if c, ok := phosphors[name]; ok {
+		return c, nil
+	}
+	if strings.HasPrefix(name, "#") && len(name) == 7 {
+		rgb, err := strconv.ParseUint(name[1:], 16, 32)
+		if err == nil {
+			return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}, nil
+		}
+	}
+	return color.RGBA{}, fmt.Errorf("unknown phosphor %q: use green, white, amber or #rrggbb", name)
+}
+
+/*
+CRT draws the pixels lit by the PET's video as they appear on its monitor.
+Everything is drawn in software, so it works without a GPU.
+
+Lit pixels glow in the colour of the phosphor. The phosphor keeps glowing
+after the beam has passed, so with Persistence each frame fades into the next,
+& with Bloom light spreads into the pixels around a bright one. Scanlines
+darkens the gaps between the scan lines; the image is drawn at twice the size
+of the framebuffer, so that the gaps are between the lines rather than over
+every other one.
+*/
+type CRT struct {
+	Phosphor    color.RGBA // Colour of a lit pixel
+	Scanlines   float64    // Darkening of the gaps between scan lines, 0 to 1
+	Persistence float64    // Brightness left from the previous frame, 0 to 1
+	Bloom       float64    // Brightness of the glow around lit pixels, 0 to 1
+
+	glow   []float32   // Brightness of each framebuffer pixel, 0 to 1
+	blur   []float32   // glow, blurred, for bloom
+	tmp    []float32   // Used while blurring
+	fading bool        // Some pixels are still fading
+	out    *image.RGBA // Image on the screen
+}
+
+// Scale returns the size in the image of each framebuffer pixel
+func (c *CRT) Scale() int {
+	if c.Scanlines > 0 {
+		return 2
+	}
+	return 1
+}
+
+// Draw updates the image from the area of the framebuffer which has changed,
+// & returns the image & the area of it which has changed. frames is the
+// number of frames the PET has displayed since the last one drawn, so that
+// the afterglow fades in emulated time however often frames are drawn; 0 is
+// the same frame again.
+func (c *CRT) Draw(lit *image.Gray, dirty image.Rectangle, frames int) (*image.RGBA, image.Rectangle) {
+	width, height := lit.Rect.Dx(), lit.Rect.Dy()
+	scale := c.Scale()
+	if c.out == nil || c.out.Rect.Dx() != width*scale || c.out.Rect.Dy() != height*scale {
+		c.out = image.NewRGBA(image.Rect(0, 0, width*scale, height*scale))
+		c.glow = make([]float32, width*height)
+		c.blur = make([]float32, width*height)
+		c.tmp = make([]float32, width*height)
+		dirty = lit.Rect
+	}
+
+	// Afterglow & bloom reach beyond the rows which have changed
+	if c.Persistence > 0 || c.Bloom > 0 {
+		if dirty.Empty() && (!c.fading || frames == 0) {
+			return c.out, dirty
+		}
+		dirty = lit.Rect
+	}
+	if dirty.Empty() {
+		return c.out, dirty
+	}
+
+	// The brightness of each pixel is the brighter of the beam & the
+	// afterglow of the previous frame
+	if frames < 1 {
+		frames = 1
+	}
+	decay := float32(math.Pow(c.Persistence, float64(frames)))
+	c.fading = false
+	for y := dirty.Min.Y; y < dirty.Max.Y; y++ {
+		for x := dirty.Min.X; x < dirty.Max.X; x++ {
+			n := y*width + x
+			b := float32(lit.Pix[lit.PixOffset(x, y)]) / 0xff
+			if g := c.glow[n] * decay; g > b && g >= CRT_GLOW_MIN {
+				b = g
+				c.fading = true
+			}
+			c.glow[n] = b
+		}
+	}
+
+	if c.Bloom > 0 {
+		boxBlur(c.blur, c.tmp, c.glow, width, height, CRT_BLOOM_RADIUS)
+	}
+
+	bloom := float32(c.Bloom)
+	gap := float32(1 - c.Scanlines)
+	r, g, b := float32(c.Phosphor.R), float32(c.Phosphor.G), float32(c.Phosphor.B)
+	for y := dirty.Min.Y * scale; y < dirty.Max.Y*scale; y++ {
+		for x := dirty.Min.X * scale; x < dirty.Max.X*scale; x++ {
+			n := (y/scale)*width + x/scale
+			bright := c.glow[n]
+			if bloom > 0 {
+				bright += bloom * c.blur[n]
+			}
+			if scale > 1 && y%scale != 0 {
+				bright *= gap
+			}
+			if bright > 1 {
+				bright = 1
+			} else if bright < 0 {
+				bright = 0
+			}
+
+			off := c.out.PixOffset(x, y)
+			c.out.Pix[off] = uint8(r*bright + 0.5)
+			c.out.Pix[off+1] = uint8(g*bright + 0.5)
+			c.out.Pix[off+2] = uint8(b*bright + 0.5)
+			c.out.Pix[off+3] = 0xff
+		}
+	}
+
+	return c.out, image.Rect(dirty.Min.X*scale, dirty.Min.Y*scale, dirty.Max.X*scale, dirty.Max.Y*scale)
+}
+
+// boxBlur sets each pixel of dst to the average of the pixels of src within
+// radius of it, horizontally & vertically. Pixels beyond the edges are black.
+func boxBlur(dst, tmp, src []float32, width, height, radius int) {
+	size := float32(2*radius + 1)
+
+	for y := 0; y < height; y++ {
+		row := src[y*width : (y+1)*width]
+		sum := float32(0)
+		for x := 0; x < radius && x < width; x++ {
+			sum += row[x]
+		}
+		for x := 0; x < width; x++ {
+			if x+radius < width {
+				sum += row[x+radius]
+			}
+			if x-radius > 0 {
+				sum -= row[x-radius-1]
+			}
+			tmp[y*width+x] = sum / size
+		}
+	}
+
+	for x := 0; x < width; x++ {
+		sum := float32(0)
+		for y := 0; y < radius && y < height; y++ {
+			sum += tmp[y*width+x]
+		}
+		for y := 0; y < height; y++ {
+			if y+radius < height {
+				sum += tmp[(y+radius)*width+x]
+			}
+			if y-radius > 0 {
+				sum -= tmp[(y-radius-1)*width+x]
+			}
+			dst[y*width+x] = sum / size
+		}
+	}
+}
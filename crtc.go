@@ -0,0 +1,136 @@
+package main
+
+// CRTC register numbers
+const (
+	CRTC_HTOTAL     = 0  // Horizontal total (characters - 1)
+	CRTC_HDISPLAYED = 1  // Horizontal displayed (characters)
+	CRTC_HSYNC      = 2  // Horizontal sync position
+	CRTC_SYNCWIDTH  = 3  // Sync widths
+	CRTC_VTOTAL     = 4  // Vertical total (character rows - 1)
+	CRTC_VADJUST    = 5  // Vertical total adjust (scan lines)
+	CRTC_VDISPLAYED = 6  // Vertical displayed (character rows)
+	CRTC_VSYNC      = 7  // Vertical sync position
+	CRTC_MODE       = 8  // Mode control
+	CRTC_SCANLINES  = 9  // Scan lines per character row - 1
+	CRTC_CURSTART   = 10 // Cursor start scan line
+	CRTC_CUREND     = 11 // Cursor end scan line
+	CRTC_STARTHI    = 12 // Display start address (high)
+	CRTC_STARTLO    = 13 // Display start address (low)
+	CRTC_CURSORHI   = 14 // Cursor address (high)
+	CRTC_CURSORLO   = 15 // Cursor address (low)
+	CRTC_LPENHI     = 16 // Light pen address (high)
+	CRTC_LPENLO     = 17 // Light pen address (low)
+
+	CRTC_REGISTERS = 18
+)
+
+// CRTC models a MOS 6545 CRT Controller
+type CRTC struct {
+	Base Word // Base address
+
+	selected Byte                 // Currently selected register
+	regs     [CRTC_REGISTERS]Byte // Registers
+}
+
+func (c *CRTC) GetBase() Word {
+	return c.Base
+}
+
+func (c *CRTC) GetSize() Word {
+	return Word(2)
+}
+
+func (c *CRTC) CheckInterrupt() bool {
+	return false
+}
+
+// Reset the CRTC to a 40 x 25 display, as though the editor ROM had
+// initialised it
+func (c *CRTC) Reset() {
+	c.selected = 0
+	c.regs = [CRTC_REGISTERS]Byte{
+		0x31, 0x28, 0x29, 0x0f, // Horizontal: 50 total, 40 displayed
+		0x27, 0x00, 0x19, 0x20, // Vertical: 40 total, 25 displayed
+		0x00, 0x07, // 8 scan lines per row
+		0x00, 0x00,
+		0x10, 0x00, // Start address $1000 (MA12 set: normal video)
+		0x00, 0x00,
+		0x00, 0x00,
+	}
+}
+
+func (c *CRTC) Read(address Word) Byte {
+	port := address - c.Base
+	switch port {
+	case 0x0: // Address register (status on a 6545)
+		return Byte(0)
+	case 0x1: // Data register
+		// Only the cursor & light pen registers can be read back
+		if c.selected >= CRTC_CURSORHI && c.selected <= CRTC_LPENLO {
+			return c.regs[c.selected]
+		}
+	}
+	return Byte(0)
+}
+
+func (c *CRTC) Write(address Word, data Byte) {
+	port := address - c.Base
+	switch port {
+	case 0x0: // Address register
+		c.selected = data & 0x1f
+	case 0x1: // Data register
+		if c.selected < CRTC_REGISTERS {
+			c.regs[c.selected] = data
+		}
+	}
+}
+
+// Additional helper functions for exposing the display configuration
+
+// Return the number of characters displayed per row
+func (c *CRTC) Columns() int {
+	return int(c.regs[CRTC_HDISPLAYED])
+}
+
+// Return the number of character rows displayed
+func (c *CRTC) Rows() int {
+	return int(c.regs[CRTC_VDISPLAYED] & 0x7f)
+}
+
+// Return the number of scan lines in each character row
+func (c *CRTC) CharHeight() int {
+	return int(c.regs[CRTC_SCANLINES]&0x1f) + 1
+}
+
+// Return the number of character clocks in each scan line
+func (c *CRTC) HorizontalTotal() int {
+	return int(c.regs[CRTC_HTOTAL]) + 1
+}
+
+// Return the number of scan lines in each frame
+func (c *CRTC) VerticalTotal() int {
+	rows := int(c.regs[CRTC_VTOTAL]&0x7f) + 1
+	return rows*c.CharHeight() + int(c.regs[CRTC_VADJUST]&0x1f)
+}
+
+// Return the character row at which vertical sync starts
+func (c *CRTC) VerticalSync() int {
+	return int(c.regs[CRTC_VSYNC] & 0x7f)
+}
+
+// Return the width of vertical sync in scan lines, or 0 if it is not set. The
+// 6545 takes it from the top four bits of the sync width register.
+func (c *CRTC) VerticalSyncWidth() int {
+	return int(c.regs[CRTC_SYNCWIDTH] >> 4)
+}
+
+// Return the display start address (MA0-MA13)
+func (c *CRTC) StartAddress() Word {
+	return Word(c.regs[CRTC_STARTHI]&0x3f)<<8 | Word(c.regs[CRTC_STARTLO])
+}
+
+// Return true if the display is inverted. On the PET, MA12 is used to select
+// normal or reverse video for the whole screen
+func (c *CRTC) Inverted() bool {
+	return c.StartAddress()&0x1000 == 0
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TAP image format
+const (
+	TAP_SIGNATURE    = "C64-TAPE-RAW"
+	TAP_HEADER_SIZE  = 20
+	TAP_VERSION      = 12 // Offset of the version
+	TAP_PLATFORM     = 13 // Offset of the platform
+	TAP_LENGTH       = 16 // Offset of the data length
+	TAP_PLATFORM_PET = 3
+	TAP_CYCLES       = 8        // Cycles for each unit of a pulse length
+	TAP_MAX_PULSE    = 0xffffff // Longest pulse an overflow can hold
+)
+
+// TapeControl is a button on the datasette
+type TapeControl int
+
+const (
+	TAPE_PLAY TapeControl = iota
+	TAPE_RECORD
+	TAPE_STOP
+	TAPE_REWIND
+)
+
+/*
+Datasette emulates cassette drive #1 at the signal level, so that the kernal
+tape routines, & any turbo loader, run unmodified. A tape is a .TAP image,
+which holds the length of each pulse read from the tape, measured in CPU cycles
+between falling edges of the read signal, or a WAV recording of a real tape.
+
+While the motor is on & PLAY is pressed, the pulses are played into PIA1 CA1.
+While RECORD is pressed, the time between rising edges of the write line (VIA
+PB3) is recorded over the tape from the current position, & the image is
+written back when the motor stops. The sense line (PIA1 PA4) is low while
+either button is pressed, & the motor is controlled by PIA1 CB2.
+*/
+type Datasette struct {
+	Filename string           // TAP image or WAV file, or "" if there is no tape
+	CA1      func(level bool) // Sets the state of the read line
+	WAV      WAVTapeOptions   // How WAV recordings are decoded
+
+	pulses []uint32 // Pulse lengths in cycles
+	pos    int      // Index of the next pulse
+	dirty  bool     // The tape has been recorded on since it was written
+
+	playing   bool // PLAY is pressed
+	recording bool // RECORD is pressed
+	motor     bool // The motor is on
+
+	clock   uint64 // Cycle count
+	elapsed uint64 // Cycles played since the tape was rewound
+	remain  int    // Cycles until the next edge of the read line
+	high    int    // Cycles the read line is high for in the current pulse
+	low     bool   // The read line is low
+
+	write    bool   // State of the write line
+	edge     uint64 // Clock at the last rising edge of the write line
+	edgeSeen bool   // edge is valid
+}
+
+// InsertTape loads a TAP image or WAV file. A file which doesn't exist is a
+// blank tape, which is created when it is recorded on.
+func (d *Datasette) InsertTape(filename string) error {
+	data, err := os.ReadFile(filename)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		d.pulses = nil
+	case err != nil:
+		return err
+	case IsWAV(data):
+		d.pulses, err = decodeTapeWAV(data, d.WAV)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	default:
+		d.pulses, err = parseTAP(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	d.Filename = filename
+	d.dirty = false
+	d.rewind()
+	return nil
+}
+
+// parseTAP returns the pulse lengths in a TAP image
+func parseTAP(data []byte) ([]uint32, error) {
+	if len(data) < TAP_HEADER_SIZE || !bytes.HasPrefix(data, []byte(TAP_SIGNATURE)) {
+		return nil, errors.New("not a TAP image")
+	}
+	version := data[TAP_VERSION]
+	if version > 1 {
+		return nil, fmt.Errorf("TAP version %d is not supported", version)
+	}
+	length := binary.LittleEndian.Uint32(data[TAP_LENGTH:])
+	data = data[TAP_HEADER_SIZE:]
+	if uint64(length) < uint64(len(data)) {
+		data = data[:length]
+	}
+
+	pulses := []uint32{}
+	for n := 0; n < len(data); n++ {
+		switch {
+		case data[n] != 0:
+			pulses = append(pulses, uint32(data[n])*TAP_CYCLES)
+		case version == 0:
+			// An overflow is a long pulse
+			pulses = append(pulses, 256*TAP_CYCLES)
+		case n+3 < len(data):
+			// An overflow is followed by the length in cycles
+			pulses = append(pulses, uint32(data[n+1])|uint32(data[n+2])<<8|uint32(data[n+3])<<16)
+			n += 3
+		default:
+			n = len(data)
+		}
+	}
+	return pulses, nil
+}
+
+// Save writes the tape to the TAP image, or as a WAV file if the filename
+// ends in .wav, if it has been recorded on
+func (d *Datasette) Save() error {
+	if d.Filename == "" || !d.dirty {
+		return nil
+	}
+	if strings.EqualFold(filepath.Ext(d.Filename), ".wav") {
+		err := writeTapeWAV(d.Filename, d.pulses)
+		if err != nil {
+			return err
+		}
+		d.dirty = false
+		return nil
+	}
+
+	tap := make([]byte, TAP_HEADER_SIZE, TAP_HEADER_SIZE+len(d.pulses))
+	copy(tap, TAP_SIGNATURE)
+	tap[TAP_VERSION] = 1
+	tap[TAP_PLATFORM] = TAP_PLATFORM_PET
+	for _, p := range d.pulses {
+		units := (p + TAP_CYCLES/2) / TAP_CYCLES
+		if units > 0 && units < 256 {
+			tap = append(tap, byte(units))
+			continue
+		}
+		if p > TAP_MAX_PULSE {
+			p = TAP_MAX_PULSE
+		}
+		tap = append(tap, 0, byte(p), byte(p>>8), byte(p>>16))
+	}
+	binary.LittleEndian.PutUint32(tap[TAP_LENGTH:], uint32(len(tap)-TAP_HEADER_SIZE))
+
+	err := os.WriteFile(d.Filename, tap, 0644)
+	if err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
+
+// Control presses a button
+func (d *Datasette) Control(c TapeControl) {
+	if d.Filename == "" && c != TAPE_STOP {
+		fmt.Fprintln(os.Stderr, "tape: no tape")
+		return
+	}
+
+	switch c {
+	case TAPE_PLAY:
+		d.playing = true
+		d.recording = false
+		fmt.Fprintf(os.Stderr, "tape: play, counter %03d\n", d.Counter())
+	case TAPE_RECORD:
+		d.playing = true
+		d.recording = true
+		d.edgeSeen = false
+		fmt.Fprintf(os.Stderr, "tape: record, counter %03d\n", d.Counter())
+	case TAPE_STOP:
+		d.playing = false
+		d.recording = false
+		if d.Filename != "" {
+			fmt.Fprintf(os.Stderr, "tape: stop, counter %03d\n", d.Counter())
+		}
+		d.saveOrReport()
+	case TAPE_REWIND:
+		d.rewind()
+		fmt.Fprintln(os.Stderr, "tape: rewind")
+		d.saveOrReport()
+	}
+}
+
+// rewind releases the buttons & winds the tape back to the start
+func (d *Datasette) rewind() {
+	d.playing = false
+	d.recording = false
+	d.pos = 0
+	d.elapsed = 0
+	d.remain = 0
+	d.setRead(true)
+}
+
+// saveOrReport saves the tape, reporting any error
+func (d *Datasette) saveOrReport() {
+	err := d.Save()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tape: %s\n", err)
+	}
+}
+
+// Counter returns the tape counter, which counts seconds from the start of the
+// tape
+func (d *Datasette) Counter() int {
+	return int(d.elapsed/CPU_CLOCK) % 1000
+}
+
+// Sense returns true if PLAY or RECORD is pressed
+func (d *Datasette) Sense() bool {
+	return d.playing
+}
+
+// SetMotor turns the motor on or off
+func (d *Datasette) SetMotor(on bool) {
+	if d.motor == on {
+		return
+	}
+	d.motor = on
+	d.edgeSeen = false
+	if !on && d.recording {
+		d.saveOrReport()
+	}
+}
+
+// SetWrite sets the state of the write line, recording a pulse on each
+// rising edge
+func (d *Datasette) SetWrite(level bool) {
+	if d.write == level {
+		return
+	}
+	d.write = level
+	if !level || !d.motor || !d.recording {
+		return
+	}
+
+	if d.edgeSeen {
+		// Record over the rest of the tape
+		d.pulses = append(d.pulses[:d.pos], uint32(d.clock-d.edge))
+		d.pos++
+		d.dirty = true
+	}
+	d.edge = d.clock
+	d.edgeSeen = true
+}
+
+// setRead sets the state of the read line
+func (d *Datasette) setRead(level bool) {
+	d.low = !level
+	if d.CA1 != nil {
+		d.CA1(level)
+	}
+}
+
+// Tick moves the tape for the given number of cycles, while the motor is on
+func (d *Datasette) Tick(cycles int) {
+	d.clock += uint64(cycles)
+	if !d.motor || !d.playing {
+		return
+	}
+	d.elapsed += uint64(cycles)
+	if d.recording {
+		return
+	}
+
+	// Each pulse is low for the first half & high for the second
+	d.remain -= cycles
+	for d.remain <= 0 {
+		if d.low {
+			d.setRead(true)
+			d.remain += d.high
+			continue
+		}
+		if d.pos >= len(d.pulses) {
+			// End of the tape
+			d.remain = 0
+			return
+		}
+		pulse := int(d.pulses[d.pos])
+		d.pos++
+		d.setRead(false)
+		d.remain += pulse / 2
+		d.high = pulse - pulse/2
+	}
+}
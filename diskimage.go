@@ -0,0 +1,733 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CBM DOS file types, as stored in a directory entry
+const (
+	FILE_DEL = 0x00
+	FILE_SEQ = 0x01
+	FILE_PRG = 0x02
+	FILE_USR = 0x03
+	FILE_REL = 0x04
+
+	FILE_TYPE   = 0x07 // Mask for the file type
+	FILE_LOCKED = 0x40 // File can't be scratched
+	FILE_CLOSED = 0x80 // File was closed properly
+)
+
+var fileTypes = []string{"DEL", "SEQ", "PRG", "USR", "REL"}
+
+const (
+	BLOCK_SIZE     = 256
+	BLOCK_DATA     = 254 // Data bytes in each block of a file
+	DIR_ENTRY_SIZE = 32
+	FILENAME_LEN   = 16
+	FILENAME_PAD   = 0xa0 // Filenames are padded with shifted spaces
+)
+
+// DiskZone is a range of tracks with the same number of sectors
+type DiskZone struct {
+	LastTrack int // Last track in the zone
+	Sectors   int // Sectors per track
+}
+
+// DiskFormat describes the layout of a disk image
+type DiskFormat struct {
+	Name     string     // Image type E.g. D64
+	Drive    string     // Commodore drive that uses the format
+	DOS      string     // Power on message
+	Tracks   int        // Number of tracks
+	Zones    []DiskZone // Sectors per track
+	Size     int        // Size of an image, without error information
+	DirTrack int        // Directory track; the header is sector 0
+
+	NameOffset int      // Offset of the disk name in the header
+	BAM        [][2]int // Track & sector of each BAM block
+	BAMOffset  int      // Offset of the first track entry in a BAM block
+	BAMTracks  int      // Tracks covered by each BAM block
+	BAMEntry   int      // Size of each track entry
+
+	Interleave    int // Sector interleave for files
+	DirInterleave int // Sector interleave for the directory
+}
+
+var (
+	// 4040 (and 2031, 1541) single sided disks
+	FORMAT_D64 = &DiskFormat{
+		Name:          "D64",
+		Drive:         "4040",
+		DOS:           "CBM DOS V2.1 4040",
+		Tracks:        35,
+		Zones:         []DiskZone{{17, 21}, {24, 19}, {30, 18}, {35, 17}},
+		Size:          174848,
+		DirTrack:      18,
+		NameOffset:    0x90,
+		BAM:           [][2]int{{18, 0}},
+		BAMOffset:     0x04,
+		BAMTracks:     35,
+		BAMEntry:      4,
+		Interleave:    10,
+		DirInterleave: 3,
+	}
+
+	// 8050 single sided disks
+	FORMAT_D80 = &DiskFormat{
+		Name:          "D80",
+		Drive:         "8050",
+		DOS:           "CBM DOS V2.5 8050",
+		Tracks:        77,
+		Zones:         []DiskZone{{39, 29}, {53, 27}, {64, 25}, {77, 23}},
+		Size:          533248,
+		DirTrack:      39,
+		NameOffset:    0x06,
+		BAM:           [][2]int{{38, 0}, {38, 3}},
+		BAMOffset:     0x06,
+		BAMTracks:     50,
+		BAMEntry:      5,
+		Interleave:    6,
+		DirInterleave: 3,
+	}
+
+	// 8250 double sided disks
+	FORMAT_D82 = &DiskFormat{
+		Name:          "D82",
+		Drive:         "8250",
+		DOS:           "CBM DOS V2.7 8250",
+		Tracks:        154,
+		Zones:         []DiskZone{{39, 29}, {53, 27}, {64, 25}, {77, 23}, {116, 29}, {130, 27}, {141, 25}, {154, 23}},
+		Size:          1066496,
+		DirTrack:      39,
+		NameOffset:    0x06,
+		BAM:           [][2]int{{38, 0}, {38, 3}, {38, 6}, {38, 9}},
+		BAMOffset:     0x06,
+		BAMTracks:     50,
+		BAMEntry:      5,
+		Interleave:    6,
+		DirInterleave: 3,
+	}
+
+	diskFormats = []*DiskFormat{FORMAT_D64, FORMAT_D80, FORMAT_D82}
+)
+
+// Sectors returns the number of sectors on a track
+func (f *DiskFormat) Sectors(track int) int {
+	for _, zone := range f.Zones {
+		if track <= zone.LastTrack {
+			return zone.Sectors
+		}
+	}
+	return 0
+}
+
+// Blocks returns the total number of blocks on a disk
+func (f *DiskFormat) Blocks() int {
+	return f.Size / BLOCK_SIZE
+}
+
+/*
+DOSError is an error reported on the command channel of a drive, E.g.
+
+	62,FILE NOT FOUND,00,00
+*/
+type DOSError struct {
+	Code   int
+	Track  int
+	Sector int
+}
+
+var dosMessages = map[int]string{
+	DOS_OK:              "OK",
+	DOS_SCRATCHED:       "FILES SCRATCHED",
+	DOS_READ_ERROR:      "READ ERROR",
+	DOS_WRITE_PROTECT:   "WRITE PROTECT ON",
+	DOS_SYNTAX_ERROR:    "SYNTAX ERROR",
+	DOS_INVALID_COMMAND: "SYNTAX ERROR",
+	DOS_LONG_LINE:       "SYNTAX ERROR",
+	DOS_INVALID_NAME:    "SYNTAX ERROR",
+	DOS_NO_FILE:         "SYNTAX ERROR",
+	DOS_FILE_OPEN:       "WRITE FILE OPEN",
+	DOS_FILE_NOT_OPEN:   "FILE NOT OPEN",
+	DOS_FILE_NOT_FOUND:  "FILE NOT FOUND",
+	DOS_FILE_EXISTS:     "FILE EXISTS",
+	DOS_TYPE_MISMATCH:   "FILE TYPE MISMATCH",
+	DOS_ILLEGAL_TS:      "ILLEGAL TRACK OR SECTOR",
+	DOS_NO_CHANNEL:      "NO CHANNEL",
+	DOS_DISK_FULL:       "DISK FULL",
+	DOS_NOT_READY:       "DRIVE NOT READY",
+}
+
+// CBM DOS error codes
+const (
+	DOS_OK              = 0
+	DOS_SCRATCHED       = 1
+	DOS_READ_ERROR      = 20
+	DOS_WRITE_PROTECT   = 26
+	DOS_SYNTAX_ERROR    = 30
+	DOS_INVALID_COMMAND = 31
+	DOS_LONG_LINE       = 32
+	DOS_INVALID_NAME    = 33
+	DOS_NO_FILE         = 34
+	DOS_FILE_OPEN       = 60
+	DOS_FILE_NOT_OPEN   = 61
+	DOS_FILE_NOT_FOUND  = 62
+	DOS_FILE_EXISTS     = 63
+	DOS_TYPE_MISMATCH   = 64
+	DOS_ILLEGAL_TS      = 66
+	DOS_NO_CHANNEL      = 70
+	DOS_DISK_FULL       = 72
+	DOS_VERSION         = 73
+	DOS_NOT_READY       = 74
+)
+
+func (e *DOSError) Error() string {
+	return fmt.Sprintf("%02d,%s,%02d,%02d", e.Code, dosMessages[e.Code], e.Track, e.Sector)
+}
+
+func dosError(code int) *DOSError {
+	return &DOSError{Code: code}
+}
+
+// DirEntry is a file in the directory of a disk image
+type DirEntry struct {
+	Type   Byte   // File type & flags
+	Track  int    // Track of the first block of the file
+	Sector int    // Sector of the first block of the file
+	Name   []byte // Filename, without padding
+	Blocks int    // Size of the file in blocks
+
+	dirTrack  int // Location of the entry in the directory
+	dirSector int
+	offset    int
+
+	hostPath string // Host file, for a host directory
+}
+
+func (e *DirEntry) TypeName() string {
+	t := int(e.Type & FILE_TYPE)
+	if t < len(fileTypes) {
+		return fileTypes[t]
+	}
+	return "???"
+}
+
+// DiskImage is a D64, D80 or D82 disk image, held in memory. Changes are
+// written back to the image file by Save.
+type DiskImage struct {
+	Filename string
+	Format   *DiskFormat
+	ReadOnly bool // The image file can't be written
+	Dirty    bool // The image has changed since it was loaded or saved
+
+	data   []byte
+	errors []byte // Per sector error information, if the image has any
+}
+
+// OpenDiskImage loads a disk image. The format is found from the size of
+// the image.
+func OpenDiskImage(filename string) (*DiskImage, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DiskImage{
+		Filename: filename,
+	}
+	for _, f := range diskFormats {
+		switch len(data) {
+		case f.Size:
+			d.Format = f
+		case f.Size + f.Blocks():
+			d.Format = f
+			d.errors = data[f.Size:]
+		}
+		if d.Format != nil {
+			break
+		}
+	}
+	if d.Format == nil {
+		return nil, fmt.Errorf("%s: unknown disk image format (%d bytes)", filename, len(data))
+	}
+	ext := strings.ToUpper(strings.TrimPrefix(filepath.Ext(filename), "."))
+	for _, f := range diskFormats {
+		if ext == f.Name && f != d.Format {
+			return nil, fmt.Errorf("%s: image size is for a %s, not a %s", filename, d.Format.Name, ext)
+		}
+	}
+	d.data = data[:d.Format.Size]
+
+	// Check if the image can be written back
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		d.ReadOnly = true
+	} else {
+		file.Close()
+	}
+	return d, nil
+}
+
+// Save writes the image back to the image file, if it has changed
+func (d *DiskImage) Save() error {
+	if !d.Dirty {
+		return nil
+	}
+	data := make([]byte, 0, len(d.data)+len(d.errors))
+	data = append(data, d.data...)
+	data = append(data, d.errors...)
+
+	err := os.WriteFile(d.Filename, data, 0644)
+	if err != nil {
+		return err
+	}
+	d.Dirty = false
+	return nil
+}
+
+// block returns the contents of a block
+func (d *DiskImage) block(track, sector int) ([]byte, error) {
+	f := d.Format
+	if track < 1 || track > f.Tracks || sector < 0 || sector >= f.Sectors(track) {
+		return nil, &DOSError{DOS_ILLEGAL_TS, track, sector}
+	}
+	offset := 0
+	for t := 1; t < track; t++ {
+		offset += f.Sectors(t)
+	}
+	offset = (offset + sector) * BLOCK_SIZE
+	return d.data[offset : offset+BLOCK_SIZE], nil
+}
+
+// DOS returns the power on message of the drive which uses the format
+func (d *DiskImage) DOS() string {
+	return d.Format.DOS
+}
+
+func (d *DiskImage) WriteProtected() bool {
+	return d.ReadOnly
+}
+
+// header returns the header block, which holds the disk name & ID
+func (d *DiskImage) header() []byte {
+	b, _ := d.block(d.Format.DirTrack, 0)
+	return b
+}
+
+// DiskName returns the disk name, padded to 16 characters
+func (d *DiskImage) DiskName() []byte {
+	offset := d.Format.NameOffset
+	return d.header()[offset : offset+FILENAME_LEN]
+}
+
+// DiskID returns the disk ID & DOS type E.g. "01 2A"
+func (d *DiskImage) DiskID() []byte {
+	offset := d.Format.NameOffset + FILENAME_LEN + 2
+	return d.header()[offset : offset+5]
+}
+
+// bamEntry returns the BAM entry for a track. The first byte is the number of
+// free sectors, followed by a bitmap with a bit set for each free sector.
+func (d *DiskImage) bamEntry(track int) []byte {
+	f := d.Format
+	n := (track - 1) / f.BAMTracks
+	b, _ := d.block(f.BAM[n][0], f.BAM[n][1])
+	offset := f.BAMOffset + ((track-1)%f.BAMTracks)*f.BAMEntry
+	return b[offset : offset+f.BAMEntry]
+}
+
+func (d *DiskImage) isFree(track, sector int) bool {
+	entry := d.bamEntry(track)
+	return entry[1+sector/8]&(1<<(sector%8)) != 0
+}
+
+// allocate marks a block as used
+func (d *DiskImage) allocate(track, sector int) {
+	entry := d.bamEntry(track)
+	if d.isFree(track, sector) {
+		entry[1+sector/8] &^= 1 << (sector % 8)
+		entry[0]--
+		d.Dirty = true
+	}
+}
+
+// free marks a block as free
+func (d *DiskImage) free(track, sector int) {
+	entry := d.bamEntry(track)
+	if !d.isFree(track, sector) {
+		entry[1+sector/8] |= 1 << (sector % 8)
+		entry[0]++
+		d.Dirty = true
+	}
+}
+
+// BlocksFree returns the number of free blocks, outside the directory track
+func (d *DiskImage) BlocksFree() int {
+	free := 0
+	for t := 1; t <= d.Format.Tracks; t++ {
+		if t != d.Format.DirTrack {
+			free += int(d.bamEntry(t)[0])
+		}
+	}
+	return free
+}
+
+// trackOrder returns the tracks to use for files, nearest to the directory
+// first
+func (d *DiskImage) trackOrder() []int {
+	f := d.Format
+	order := make([]int, 0, f.Tracks)
+	for n := 1; n < f.Tracks; n++ {
+		if t := f.DirTrack - n; t >= 1 {
+			order = append(order, t)
+		}
+		if t := f.DirTrack + n; t <= f.Tracks {
+			order = append(order, t)
+		}
+	}
+	return order
+}
+
+// findFree finds a free block on a track, interleaved from the given sector
+func (d *DiskImage) findFree(track, sector, interleave int) (int, bool) {
+	n := d.Format.Sectors(track)
+	if d.bamEntry(track)[0] == 0 {
+		return 0, false
+	}
+	for i := 0; i < n; i++ {
+		s := (sector + interleave + i) % n
+		if d.isFree(track, s) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// nextFree allocates the block following the given block of a file. track
+// is 0 for the first block of the file.
+func (d *DiskImage) nextFree(track, sector int) (int, int, error) {
+	order := d.trackOrder()
+	start := 0
+	for n, t := range order {
+		if t == track {
+			start = n
+		}
+	}
+	for n, t := range order[start:] {
+		interleave := d.Format.Interleave
+		if n > 0 || track == 0 {
+			sector, interleave = 0, 0
+		}
+		s, ok := d.findFree(t, sector, interleave)
+		if ok {
+			d.allocate(t, s)
+			return t, s, nil
+		}
+	}
+	return 0, 0, dosError(DOS_DISK_FULL)
+}
+
+// chain follows the links from a block, calling f with each block. The
+// number of blocks is limited, in case the chain has a loop.
+func (d *DiskImage) chain(track, sector int, f func(track, sector int, b []byte) error) error {
+	for n := 0; track != 0; n++ {
+		if n > d.Format.Blocks() {
+			return &DOSError{DOS_ILLEGAL_TS, track, sector}
+		}
+		b, err := d.block(track, sector)
+		if err != nil {
+			return err
+		}
+		err = f(track, sector, b)
+		if err != nil {
+			return err
+		}
+		track, sector = int(b[0]), int(b[1])
+	}
+	return nil
+}
+
+// Directory returns all of the files in the directory, including scratched
+// entries
+func (d *DiskImage) Directory() ([]*DirEntry, error) {
+	entries := []*DirEntry{}
+	err := d.chain(d.Format.DirTrack, 1, func(track, sector int, b []byte) error {
+		for offset := 0; offset < BLOCK_SIZE; offset += DIR_ENTRY_SIZE {
+			entries = append(entries, readDirEntry(b[offset:offset+DIR_ENTRY_SIZE], track, sector, offset))
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func readDirEntry(b []byte, track, sector, offset int) *DirEntry {
+	name := b[5 : 5+FILENAME_LEN]
+	for len(name) > 0 && name[len(name)-1] == FILENAME_PAD {
+		name = name[:len(name)-1]
+	}
+	return &DirEntry{
+		Type:      Byte(b[2]),
+		Track:     int(b[3]),
+		Sector:    int(b[4]),
+		Name:      append([]byte{}, name...),
+		Blocks:    int(b[30]) | int(b[31])<<8,
+		dirTrack:  track,
+		dirSector: sector,
+		offset:    offset,
+	}
+}
+
+// dirEntry returns the raw directory entry
+func (d *DiskImage) dirEntry(e *DirEntry) []byte {
+	b, _ := d.block(e.dirTrack, e.dirSector)
+	return b[e.offset : e.offset+DIR_ENTRY_SIZE]
+}
+
+/*
+matchName compares a filename with a pattern, which can include wildcards:
+
+	?	matches any character
+	*	matches the rest of the name
+*/
+func matchName(pattern, name []byte) bool {
+	for n, c := range pattern {
+		if c == '*' {
+			return true
+		}
+		if n >= len(name) || (c != '?' && c != name[n]) {
+			return false
+		}
+	}
+	return len(pattern) == len(name)
+}
+
+// ReadFile returns the contents of a file
+func (d *DiskImage) ReadFile(e *DirEntry) ([]byte, error) {
+	data := []byte{}
+	err := d.chain(e.Track, e.Sector, func(track, sector int, b []byte) error {
+		if b[0] != 0 {
+			data = append(data, b[2:]...)
+		} else if b[1] >= 2 {
+			// The last block holds the offset of the last byte
+			data = append(data, b[2:int(b[1])+1]...)
+		}
+		return nil
+	})
+	return data, err
+}
+
+// WriteFile writes a new file & adds it to the directory
+func (d *DiskImage) WriteFile(name []byte, fileType Byte, data []byte) error {
+	if d.ReadOnly {
+		return dosError(DOS_WRITE_PROTECT)
+	}
+	blocks := (len(data) + BLOCK_DATA - 1) / BLOCK_DATA
+	if blocks == 0 {
+		blocks = 1
+	}
+	if blocks > d.BlocksFree() {
+		return dosError(DOS_DISK_FULL)
+	}
+	entry, err := d.newDirEntry()
+	if err != nil {
+		return err
+	}
+
+	// Write the data
+	first := [2]int{}
+	var prev []byte
+	track, sector := 0, 0
+	for n := 0; n < blocks; n++ {
+		track, sector, err = d.nextFree(track, sector)
+		if err != nil {
+			return err
+		}
+		b, _ := d.block(track, sector)
+		if prev == nil {
+			first = [2]int{track, sector}
+		} else {
+			prev[0], prev[1] = byte(track), byte(sector)
+		}
+
+		chunk := data[n*BLOCK_DATA:]
+		if len(chunk) > BLOCK_DATA {
+			chunk = chunk[:BLOCK_DATA]
+		}
+		for i := range b {
+			b[i] = 0x00
+		}
+		copy(b[2:], chunk)
+		b[0], b[1] = 0x00, byte(len(chunk)+1)
+		prev = b
+	}
+
+	// Add the directory entry
+	entry[2] = FILE_CLOSED | byte(fileType&FILE_TYPE)
+	entry[3], entry[4] = byte(first[0]), byte(first[1])
+	for n := 0; n < FILENAME_LEN; n++ {
+		if n < len(name) {
+			entry[5+n] = name[n]
+		} else {
+			entry[5+n] = FILENAME_PAD
+		}
+	}
+	for n := 21; n < 30; n++ {
+		entry[n] = 0x00
+	}
+	entry[30], entry[31] = byte(blocks), byte(blocks>>8)
+	d.Dirty = true
+	return nil
+}
+
+// newDirEntry finds an unused directory entry, extending the directory if
+// it is full
+func (d *DiskImage) newDirEntry() ([]byte, error) {
+	entries, err := d.Directory()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type == FILE_DEL {
+			return d.dirEntry(e), nil
+		}
+	}
+
+	// Add a block to the end of the directory
+	last := entries[len(entries)-1]
+	track := d.Format.DirTrack
+	sector, ok := d.findFree(track, last.dirSector, d.Format.DirInterleave)
+	if !ok {
+		return nil, dosError(DOS_DISK_FULL)
+	}
+	d.allocate(track, sector)
+
+	prev, _ := d.block(last.dirTrack, last.dirSector)
+	prev[0], prev[1] = byte(track), byte(sector)
+	b, _ := d.block(track, sector)
+	for i := range b {
+		b[i] = 0x00
+	}
+	b[1] = 0xff
+	return b[:DIR_ENTRY_SIZE], nil
+}
+
+// Scratch deletes a file & frees its blocks
+func (d *DiskImage) Scratch(e *DirEntry) error {
+	if d.ReadOnly {
+		return dosError(DOS_WRITE_PROTECT)
+	}
+	if e.Type&FILE_CLOSED != 0 {
+		err := d.freeFile(e)
+		if err != nil {
+			return err
+		}
+	}
+	d.dirEntry(e)[2] = FILE_DEL
+	d.Dirty = true
+	return nil
+}
+
+// freeFile frees the blocks used by a file
+func (d *DiskImage) freeFile(e *DirEntry) error {
+	free := func(track, sector int, b []byte) error {
+		d.free(track, sector)
+		return nil
+	}
+	err := d.chain(e.Track, e.Sector, free)
+	if err != nil {
+		return err
+	}
+	if e.Type&FILE_TYPE == FILE_REL {
+		// Side sectors
+		b := d.dirEntry(e)
+		return d.chain(int(b[21]), int(b[22]), free)
+	}
+	return nil
+}
+
+// Rename changes the name of a file
+func (d *DiskImage) Rename(e *DirEntry, name []byte) error {
+	if d.ReadOnly {
+		return dosError(DOS_WRITE_PROTECT)
+	}
+	b := d.dirEntry(e)
+	for n := 0; n < FILENAME_LEN; n++ {
+		if n < len(name) {
+			b[5+n] = name[n]
+		} else {
+			b[5+n] = FILENAME_PAD
+		}
+	}
+	d.Dirty = true
+	return nil
+}
+
+// Validate rebuilds the BAM from the directory. Files which were not closed
+// are removed.
+func (d *DiskImage) Validate() error {
+	if d.ReadOnly {
+		return dosError(DOS_WRITE_PROTECT)
+	}
+	f := d.Format
+
+	// Free everything
+	for t := 1; t <= f.Tracks; t++ {
+		entry := d.bamEntry(t)
+		n := f.Sectors(t)
+		entry[0] = byte(n)
+		for s := 0; s < len(entry[1:])*8; s++ {
+			if s < n {
+				entry[1+s/8] |= 1 << (s % 8)
+			} else {
+				entry[1+s/8] &^= 1 << (s % 8)
+			}
+		}
+	}
+	d.Dirty = true
+
+	// The header, BAM & directory are always in use
+	d.allocate(f.DirTrack, 0)
+	for _, ts := range f.BAM {
+		d.allocate(ts[0], ts[1])
+	}
+	err := d.chain(f.DirTrack, 1, func(track, sector int, b []byte) error {
+		d.allocate(track, sector)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	entries, err := d.Directory()
+	if err != nil {
+		return err
+	}
+	used := func(track, sector int, b []byte) error {
+		d.allocate(track, sector)
+		return nil
+	}
+	for _, e := range entries {
+		if e.Type == FILE_DEL {
+			continue
+		}
+		if e.Type&FILE_CLOSED == 0 {
+			d.dirEntry(e)[2] = FILE_DEL
+			continue
+		}
+		err = d.chain(e.Track, e.Sector, used)
+		if err != nil {
+			return err
+		}
+		if e.Type&FILE_TYPE == FILE_REL {
+			b := d.dirEntry(e)
+			err = d.chain(int(b[21]), int(b[22]), used)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
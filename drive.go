@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Drive channels
+const (
+	CHANNEL_LOAD    = 0  // Channel used by LOAD
+	CHANNEL_SAVE    = 1  // Channel used by SAVE
+	CHANNEL_COMMAND = 15 // Command & error channel
+	CHANNELS        = 16
+)
+
+// Disk is the storage used by a drive; a disk image or a host directory
+type Disk interface {
+	DiskName() []byte     // Disk name, padded to 16 characters
+	DiskID() []byte       // Disk ID & DOS type E.g. "01 2A"
+	DOS() string          // Power on message
+	BlocksFree() int      // Number of free blocks
+	WriteProtected() bool // The disk can't be written
+
+	Directory() ([]*DirEntry, error)
+	ReadFile(e *DirEntry) ([]byte, error)
+	WriteFile(name []byte, fileType Byte, data []byte) error
+	Scratch(e *DirEntry) error
+	Rename(e *DirEntry, name []byte) error
+	Validate() error
+
+	// Save writes any changes back to the host
+	Save() error
+}
+
+// OpenDisk opens a disk image, or a host directory
+func OpenDisk(path string, seqASCII bool) (Disk, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return OpenHostDir(path, seqASCII)
+	}
+	return OpenDiskImage(path)
+}
+
+// findFile returns the first file on a disk which matches the pattern, or
+// nil
+func findFile(disk Disk, pattern []byte) (*DirEntry, error) {
+	entries, err := disk.Directory()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type != FILE_DEL && matchName(pattern, e.Name) {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// driveChannel is an open file. Files are read into memory when they're
+// opened & written to the disk image when they're closed.
+type driveChannel struct {
+	data  []byte // File contents
+	pos   int    // Next byte to send
+	write bool   // File is open for writing
+
+	name     []byte    // Name of a file being written
+	fileType Byte      // Type of a file being written
+	replace  *DirEntry // Existing file to replace when the file is closed
+}
+
+/*
+Drive emulates a Commodore disk drive running CBM DOS, with a disk image or
+host directory in drive 0. Files are accessed by channel, where the channel is the
+secondary address used to open the file:
+
+	0	LOAD
+	1	SAVE
+	2-14	data files (OPEN, PRINT#, INPUT# & GET#)
+	15	commands & error messages
+*/
+type Drive struct {
+	Disk Disk // Disk in drive 0, or nil if the drive is empty
+
+	channels [CHANNELS]*driveChannel
+
+	listen  int    // Channel being listened on, or -1
+	opening bool   // Receiving a filename rather than data
+	buffer  []byte // Filename or command being received
+	talk    int    // Channel being read, or -1
+
+	status  *DOSError // Current error
+	message []byte    // Error message being sent
+}
+
+// NewDrive creates a drive with a disk, which may be nil
+func NewDrive(disk Disk) *Drive {
+	d := &Drive{
+		Disk: disk,
+	}
+	d.Reset()
+	return d
+}
+
+// Reset the drive as though it had been powered on
+func (d *Drive) Reset() {
+	d.channels = [CHANNELS]*driveChannel{}
+	d.listen = -1
+	d.talk = -1
+	d.buffer = nil
+	d.setStatus(dosError(DOS_VERSION))
+}
+
+func (d *Drive) setStatus(err *DOSError) {
+	d.status = err
+	d.message = nil
+}
+
+// setError sets the status from an error returned by the disk
+func (d *Drive) setError(err error) {
+	if e, ok := err.(*DOSError); ok {
+		d.setStatus(e)
+	} else {
+		d.setStatus(dosError(DOS_READ_ERROR))
+	}
+}
+
+// LoadFile reads a file as LOAD does, for the LOAD trap. ok is false if the
+// file can't be read, & the error channel holds the reason.
+func (d *Drive) LoadFile(filename []byte) ([]byte, bool) {
+	d.open(CHANNEL_LOAD, filename)
+	ch := d.channels[CHANNEL_LOAD]
+	d.channels[CHANNEL_LOAD] = nil
+	if ch == nil {
+		return nil, false
+	}
+	return ch.data, true
+}
+
+// SaveFile writes a file as SAVE does, for the SAVE trap. Any error is left
+// on the error channel.
+func (d *Drive) SaveFile(filename []byte, data []byte) {
+	d.open(CHANNEL_SAVE, filename)
+	ch := d.channels[CHANNEL_SAVE]
+	if ch == nil {
+		return
+	}
+	ch.data = append(ch.data, data...)
+	d.close(CHANNEL_SAVE)
+}
+
+// Flush writes any changes to the disk back to the host
+func (d *Drive) Flush() error {
+	if d.Disk == nil {
+		return nil
+	}
+	return d.Disk.Save()
+}
+
+func (d *Drive) Listen(secondary Byte) {
+	channel := int(secondary & 0x0f)
+	switch secondary & 0xf0 {
+	case IEEE_OPEN:
+		d.listen = channel
+		d.opening = true
+		d.buffer = nil
+	case IEEE_DATA:
+		d.listen = channel
+		d.opening = false
+		d.buffer = nil
+	case IEEE_CLOSE:
+		d.close(channel)
+	}
+}
+
+func (d *Drive) Unlisten() {
+	switch {
+	case d.listen < 0:
+	case d.opening:
+		d.open(d.listen, d.buffer)
+	case d.listen == CHANNEL_COMMAND && len(d.buffer) > 0:
+		d.command(d.buffer)
+	}
+	d.listen = -1
+	d.buffer = nil
+}
+
+func (d *Drive) Talk(secondary Byte) {
+	if secondary&0xf0 == IEEE_DATA {
+		d.talk = int(secondary & 0x0f)
+	}
+}
+
+func (d *Drive) Untalk() {
+	d.talk = -1
+}
+
+func (d *Drive) Receive(data Byte, eoi bool) {
+	if d.listen < 0 {
+		return
+	}
+	if d.opening || d.listen == CHANNEL_COMMAND {
+		d.buffer = append(d.buffer, byte(data))
+		return
+	}
+
+	// Keep the error from a failed OPEN, rather than reporting each byte
+	ch := d.channels[d.listen]
+	if ch == nil || !ch.write {
+		if d.status.Code < DOS_READ_ERROR {
+			d.setStatus(dosError(DOS_FILE_NOT_OPEN))
+		}
+		return
+	}
+	ch.data = append(ch.data, byte(data))
+}
+
+func (d *Drive) Send() (Byte, bool, bool) {
+	if d.talk < 0 {
+		return 0, false, false
+	}
+
+	if d.talk == CHANNEL_COMMAND {
+		// Send the error message, then reset it to OK
+		if d.message == nil {
+			d.message = []byte(d.statusMessage())
+		}
+		data := d.message[0]
+		d.message = d.message[1:]
+		if len(d.message) == 0 {
+			d.setStatus(dosError(DOS_OK))
+			return Byte(data), true, true
+		}
+		return Byte(data), false, true
+	}
+
+	ch := d.channels[d.talk]
+	if ch == nil || ch.write || ch.pos >= len(ch.data) {
+		return 0, false, false
+	}
+	data := ch.data[ch.pos]
+	ch.pos++
+	return Byte(data), ch.pos == len(ch.data), true
+}
+
+// statusMessage returns the current error message, as sent on the command
+// channel
+func (d *Drive) statusMessage() string {
+	if d.status.Code == DOS_VERSION {
+		dos := "CBM DOS V2"
+		if d.Disk != nil {
+			dos = d.Disk.DOS()
+		}
+		return fmt.Sprintf("%02d,%s,%02d,%02d\r", d.status.Code, dos, 0, 0)
+	}
+	return d.status.Error() + "\r"
+}
+
+// Parsed filename or command
+type driveFilename struct {
+	replace  bool   // @ prefix
+	drive    int    // Drive number
+	name     []byte // Filename or pattern
+	fileType byte   // Type letter (D, S, P, U or L), or 0
+	mode     byte   // Mode letter (R, W, A or M), or 0
+}
+
+// parseFilename splits a filename of the form "[@][d:]name[,type[,mode]]"
+func parseFilename(filename []byte) driveFilename {
+	var f driveFilename
+
+	if len(filename) > 0 && filename[0] == '@' {
+		f.replace = true
+		filename = filename[1:]
+	}
+	if n := bytes.IndexByte(filename, ':'); n >= 0 {
+		if n > 0 && filename[n-1] == '1' {
+			f.drive = 1
+		}
+		filename = filename[n+1:]
+	}
+	parts := bytes.Split(filename, []byte(","))
+	f.name = parts[0]
+	for _, p := range parts[1:] {
+		if len(p) == 0 {
+			continue
+		}
+		if bytes.IndexByte([]byte("RWAM"), p[0]) >= 0 {
+			f.mode = p[0]
+		} else {
+			f.fileType = p[0]
+		}
+	}
+	return f
+}
+
+// checkDrive returns an error if a disk can't be used
+func (d *Drive) checkDrive(drive int) *DOSError {
+	if d.Disk == nil || drive != 0 {
+		return dosError(DOS_NOT_READY)
+	}
+	return nil
+}
+
+// open opens a file on a channel
+func (d *Drive) open(channel int, filename []byte) {
+	if channel == CHANNEL_COMMAND {
+		if len(filename) > 0 {
+			d.command(filename)
+		}
+		return
+	}
+
+	// Opening a channel closes any file already open on it
+	d.close(channel)
+
+	// The name ends at a carriage return, if PRINT# was used to send it
+	filename, _, _ = bytes.Cut(filename, []byte{'\r'})
+	if len(filename) == 0 {
+		d.setStatus(dosError(DOS_NO_FILE))
+		return
+	}
+
+	f := parseFilename(filename)
+	if filename[0] == '$' {
+		f = parseFilename(filename[1:])
+		if f.drive == 0 && len(filename) > 1 && filename[1] == '1' {
+			f.drive = 1
+		}
+		if len(f.name) == 0 || bytes.IndexByte(filename, ':') < 0 {
+			f.name = []byte("*")
+		}
+	}
+	if err := d.checkDrive(f.drive); err != nil {
+		d.setStatus(err)
+		return
+	}
+
+	if filename[0] == '$' {
+		data, err := d.directory(f.name)
+		if err != nil {
+			d.setError(err)
+			return
+		}
+		d.channels[channel] = &driveChannel{data: data}
+		d.setStatus(dosError(DOS_OK))
+		return
+	}
+
+	var fileType Byte
+	switch f.fileType {
+	case 0:
+	case 'D':
+		fileType = FILE_DEL
+	case 'S':
+		fileType = FILE_SEQ
+	case 'P':
+		fileType = FILE_PRG
+	case 'U':
+		fileType = FILE_USR
+	case 'L':
+		// Relative files are not supported
+		d.setStatus(dosError(DOS_TYPE_MISMATCH))
+		return
+	default:
+		d.setStatus(dosError(DOS_INVALID_NAME))
+		return
+	}
+
+	// LOAD reads & SAVE writes a PRG file
+	mode := f.mode
+	switch channel {
+	case CHANNEL_LOAD:
+		mode = 'R'
+	case CHANNEL_SAVE:
+		mode = 'W'
+		if fileType == 0 {
+			fileType = FILE_PRG
+		}
+	}
+
+	entry, err := findFile(d.Disk, f.name)
+	if err != nil {
+		d.setError(err)
+		return
+	}
+
+	switch mode {
+	case 0, 'R':
+		if entry == nil || entry.Type&FILE_CLOSED == 0 {
+			d.setStatus(dosError(DOS_FILE_NOT_FOUND))
+			return
+		}
+		if f.fileType != 0 && entry.Type&FILE_TYPE != fileType {
+			d.setStatus(dosError(DOS_TYPE_MISMATCH))
+			return
+		}
+		data, err := d.Disk.ReadFile(entry)
+		if err != nil {
+			d.setError(err)
+			return
+		}
+		d.channels[channel] = &driveChannel{data: data}
+	case 'W', 'A':
+		if d.Disk.WriteProtected() {
+			d.setStatus(dosError(DOS_WRITE_PROTECT))
+			return
+		}
+		if bytes.ContainsAny(f.name, "*?") || len(f.name) > FILENAME_LEN {
+			d.setStatus(dosError(DOS_INVALID_NAME))
+			return
+		}
+		if f.fileType == 0 && fileType == 0 {
+			fileType = FILE_SEQ
+		}
+		ch := &driveChannel{
+			write:    true,
+			name:     append([]byte{}, f.name...),
+			fileType: fileType,
+		}
+		if mode == 'A' {
+			if entry == nil {
+				d.setStatus(dosError(DOS_FILE_NOT_FOUND))
+				return
+			}
+			ch.data, err = d.Disk.ReadFile(entry)
+			if err != nil {
+				d.setError(err)
+				return
+			}
+			ch.fileType = entry.Type & FILE_TYPE
+			ch.replace = entry
+		} else if entry != nil {
+			if !f.replace {
+				d.setStatus(dosError(DOS_FILE_EXISTS))
+				return
+			}
+			ch.replace = entry
+		}
+		d.channels[channel] = ch
+	default:
+		d.setStatus(dosError(DOS_INVALID_NAME))
+		return
+	}
+	d.setStatus(dosError(DOS_OK))
+}
+
+// close closes the file open on a channel. Closing the command channel
+// closes all files.
+func (d *Drive) close(channel int) {
+	if channel == CHANNEL_COMMAND {
+		for n := 0; n < CHANNEL_COMMAND; n++ {
+			d.close(n)
+		}
+		return
+	}
+
+	ch := d.channels[channel]
+	d.channels[channel] = nil
+	if ch == nil || !ch.write {
+		return
+	}
+
+	// The file being replaced is only scratched once the new file has been
+	// written, so that it isn't lost if the disk is full
+	err := d.Disk.WriteFile(ch.name, ch.fileType, ch.data)
+	if err == nil && ch.replace != nil && !d.overwritten(ch) {
+		err = d.Disk.Scratch(ch.replace)
+	}
+	if err != nil {
+		d.setError(err)
+	}
+	d.flush()
+}
+
+// overwritten returns true if writing the file on a channel overwrote the
+// file it replaces, as on a host directory when they have the same name
+func (d *Drive) overwritten(ch *driveChannel) bool {
+	h, ok := d.Disk.(*HostDir)
+	return ok && h.overwrites(ch.replace, ch.name, ch.fileType)
+}
+
+// flush writes the disk back to the host. The error channel can only report
+// a DOS error, so any other error is also reported on stderr.
+func (d *Drive) flush() {
+	err := d.Flush()
+	if err == nil {
+		return
+	}
+	if _, ok := err.(*DOSError); !ok {
+		fmt.Fprintf(os.Stderr, "drive: %s\n", err)
+	}
+	d.setError(err)
+}
+
+// command executes a DOS command sent on the command channel
+func (d *Drive) command(cmd []byte) {
+	cmd, _, _ = bytes.Cut(cmd, []byte{'\r'})
+	if len(cmd) == 0 {
+		return
+	}
+
+	// The drive number follows the command, E.g. "S0:name", "I0" or "I"
+	args := cmd[1:]
+	drive := 0
+	if n := bytes.IndexByte(args, ':'); n >= 0 {
+		if n > 0 && args[n-1] == '1' {
+			drive = 1
+		}
+		args = args[n+1:]
+	} else if len(args) > 0 && args[0] == '1' {
+		drive = 1
+	}
+	if err := d.checkDrive(drive); err != nil {
+		d.setStatus(err)
+		return
+	}
+
+	var err error
+	switch cmd[0] {
+	case 'I': // Initialize
+		d.setStatus(dosError(DOS_OK))
+	case 'S': // Scratch
+		err = d.scratch(args)
+	case 'R': // Rename
+		err = d.rename(args)
+	case 'V': // Validate
+		err = d.Disk.Validate()
+		if err == nil {
+			d.setStatus(dosError(DOS_OK))
+		}
+	default:
+		d.setStatus(dosError(DOS_INVALID_COMMAND))
+	}
+	if err != nil {
+		d.setError(err)
+	}
+	d.flush()
+}
+
+// scratch deletes the files matching a list of patterns
+func (d *Drive) scratch(args []byte) error {
+	if len(args) == 0 {
+		return dosError(DOS_NO_FILE)
+	}
+
+	count := 0
+	for _, pattern := range bytes.Split(args, []byte(",")) {
+		entries, err := d.Disk.Directory()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Type == FILE_DEL || e.Type&FILE_LOCKED != 0 || !matchName(pattern, e.Name) {
+				continue
+			}
+			err = d.Disk.Scratch(e)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	d.setStatus(&DOSError{Code: DOS_SCRATCHED, Track: count})
+	return nil
+}
+
+// rename changes the name of a file, given "new=old"
+func (d *Drive) rename(args []byte) error {
+	newName, oldName, ok := bytes.Cut(args, []byte("="))
+	if !ok || len(newName) == 0 || len(oldName) == 0 {
+		return dosError(DOS_NO_FILE)
+	}
+	if n := bytes.IndexByte(oldName, ':'); n >= 0 {
+		oldName = oldName[n+1:]
+	}
+	if bytes.ContainsAny(newName, "*?") || len(newName) > FILENAME_LEN {
+		return dosError(DOS_INVALID_NAME)
+	}
+
+	entry, err := findFile(d.Disk, newName)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return dosError(DOS_FILE_EXISTS)
+	}
+	entry, err = findFile(d.Disk, oldName)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return dosError(DOS_FILE_NOT_FOUND)
+	}
+	err = d.Disk.Rename(entry, newName)
+	if err != nil {
+		return err
+	}
+	d.setStatus(dosError(DOS_OK))
+	return nil
+}
+
+/*
+directory returns the directory as a BASIC program, which can be LOADed &
+LISTed:
+
+	0 "DISK NAME       " ID 2A
+	12   "FILENAME"         PRG
+	652 BLOCKS FREE.
+*/
+func (d *Drive) directory(pattern []byte) ([]byte, error) {
+	entries, err := d.Disk.Directory()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each line has a dummy link, which is fixed when the program is loaded
+	data := []byte{0x01, 0x04}
+	line := func(number int, text []byte) {
+		data = append(data, 0x01, 0x01, byte(number), byte(number>>8))
+		data = append(data, text...)
+		data = append(data, 0x00)
+	}
+	unpad := func(b []byte) []byte {
+		return bytes.ReplaceAll(b, []byte{FILENAME_PAD}, []byte{' '})
+	}
+
+	// Header, in reverse
+	header := []byte{0x12, '"'}
+	header = append(header, unpad(d.Disk.DiskName())...)
+	header = append(header, '"', ' ')
+	header = append(header, unpad(d.Disk.DiskID())...)
+	line(0, header)
+
+	for _, e := range entries {
+		if e.Type == FILE_DEL || !matchName(pattern, e.Name) {
+			continue
+		}
+		// The size is the line number; pad it to line up the names. A
+		// corrupt entry can have a size of more than four digits.
+		pad := 4 - len(strconv.Itoa(e.Blocks))
+		if pad < 0 {
+			pad = 0
+		}
+		text := bytes.Repeat([]byte{' '}, pad)
+		text = append(text, '"')
+		text = append(text, e.Name...)
+		text = append(text, '"')
+		text = append(text, bytes.Repeat([]byte{' '}, FILENAME_LEN-len(e.Name))...)
+		if e.Type&FILE_CLOSED == 0 {
+			text = append(text, '*')
+		} else {
+			text = append(text, ' ')
+		}
+		text = append(text, e.TypeName()...)
+		if e.Type&FILE_LOCKED != 0 {
+			text = append(text, '<')
+		}
+		line(e.Blocks, text)
+	}
+
+	line(d.Disk.BlocksFree(), []byte("BLOCKS FREE."))
+	data = append(data, 0x00, 0x00)
+	return data, nil
+}
@@ -12,6 +12,9 @@ const (
 	EV_NONE     = iota // Nothing happened
 	EV_QUIT            // Quit
 	EV_KEYPRESS        // Key press
+	EV_TAPE            // Datasette button
+	EV_JOYSTICK        // Joystick moved
+	EV_CHARSET         // Reload the character set
 )
 
 // EventNone is the nil/nothing happened event
@@ -36,3 +39,30 @@ type EventKeypress struct {
 func (e EventKeypress) GetType() EventType {
 	return EV_KEYPRESS
 }
+
+// EventTape is sent when a datasette button is pressed
+type EventTape struct {
+	Control TapeControl
+}
+
+func (e EventTape) GetType() EventType {
+	return EV_TAPE
+}
+
+// EventJoystick is sent when the inputs of a joystick change
+type EventJoystick struct {
+	Joystick int  // Joystick number, from 0
+	State    Byte // Inputs held E.g. JOY_UP|JOY_FIRE
+}
+
+func (e EventJoystick) GetType() EventType {
+	return EV_JOYSTICK
+}
+
+// EventCharset is sent to reload the character ROM image, to show changes to
+// a custom character set
+type EventCharset struct{}
+
+func (e EventCharset) GetType() EventType {
+	return EV_CHARSET
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"compress/lzw"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+)
+
+// GIF block introducers & labels
+const (
+	gifExtension    = 0x21
+	gifImage        = 0x2c
+	gifTrailer      = 0x3b
+	gifGraphicLabel = 0xf9
+	gifAppLabel     = 0xff
+	gifDisposalNone = 0x04 // Graphic control: leave the frame in place
+	gifColourBits   = 8    // Bits per pixel; the palette has 256 colours
+)
+
+/*
+GIFWriter writes an animated GIF a frame at a time, so that a recording isn't
+kept in memory. Every frame uses the global palette, & is drawn over the last,
+so a frame need only cover the area which has changed. The animation loops.
+*/
+type GIFWriter struct {
+	out io.Writer
+	err error // First error writing the file
+}
+
+// NewGIFWriter writes the header of a GIF of the given size & palette, which
+// must have 256 colours
+func NewGIFWriter(out io.Writer, width, height int, palette color.Palette) (*GIFWriter, error) {
+	g := &GIFWriter{out: out}
+	header := []byte("GIF89a")
+	header = binary.LittleEndian.AppendUint16(header, uint16(width))
+	header = binary.LittleEndian.AppendUint16(header, uint16(height))
+	header = append(header, 0x80|(gifColourBits-1)<<4|(gifColourBits-1), 0, 0)
+	for _, c := range palette {
+		r, g, b, _ := c.RGBA()
+		header = append(header, byte(r>>8), byte(g>>8), byte(b>>8))
+	}
+
+	// NETSCAPE2.0 extension, to loop forever
+	header = append(header, gifExtension, gifAppLabel, 11)
+	header = append(header, "NETSCAPE2.0"...)
+	header = append(header, 3, 1, 0, 0, 0)
+	g.write(header)
+	return g, g.err
+}
+
+func (g *GIFWriter) write(data []byte) {
+	if g.err == nil {
+		_, g.err = g.out.Write(data)
+	}
+}
+
+// WriteFrame writes a frame, which is shown for delay 1/100ths of a second
+func (g *GIFWriter) WriteFrame(img *image.Paletted, delay int) error {
+	header := []byte{gifExtension, gifGraphicLabel, 4, gifDisposalNone}
+	header = binary.LittleEndian.AppendUint16(header, uint16(delay))
+	header = append(header, 0, 0, gifImage)
+	for _, n := range []int{img.Rect.Min.X, img.Rect.Min.Y, img.Rect.Dx(), img.Rect.Dy()} {
+		header = binary.LittleEndian.AppendUint16(header, uint16(n))
+	}
+	header = append(header, 0, gifColourBits)
+	g.write(header)
+
+	// The LZW compressed pixels are split into blocks
+	blocks := &gifBlockWriter{g: g}
+	lz := lzw.NewWriter(blocks, lzw.LSB, gifColourBits)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y && g.err == nil; y++ {
+		offset := img.PixOffset(img.Rect.Min.X, y)
+		_, err := lz.Write(img.Pix[offset : offset+img.Rect.Dx()])
+		if err != nil && g.err == nil {
+			g.err = err
+		}
+	}
+	if err := lz.Close(); err != nil && g.err == nil {
+		g.err = err
+	}
+	blocks.flush()
+	g.write([]byte{0})
+	return g.err
+}
+
+// Close writes the end of the GIF
+func (g *GIFWriter) Close() error {
+	g.write([]byte{gifTrailer})
+	return g.err
+}
+
+// gifBlockWriter splits data into GIF sub-blocks of up to 255 bytes
+type gifBlockWriter struct {
+	g   *GIFWriter
+	buf [256]byte // Length & data of the block
+	n   int       // Bytes of data in the block
+}
+
+func (b *gifBlockWriter) Write(data []byte) (int, error) {
+	for _, c := range data {
+		b.n++
+		b.buf[b.n] = c
+		if b.n == 255 {
+			b.flush()
+		}
+	}
+	return len(data), b.g.err
+}
+
+func (b *gifBlockWriter) flush() {
+	if b.n == 0 {
+		return
+	}
+	b.buf[0] = byte(b.n)
+	b.g.write(b.buf[:b.n+1])
+	b.n = 0
+}
@@ -2,18 +2,17 @@ package main
 
 import (
 	"context"
-	"image/color"
+	"fmt"
+	"image"
+	"os"
+	"strings"
 	"unicode/utf8"
+	"unsafe"
 
 	"github.com/sqweek/dialog"
 	"github.com/veandco/go-sdl2/sdl"
 )
 
-const (
-	windowHeight = 480
-	windowWidth  = 360
-)
-
 var scancodes = map[sdl.Keycode]Byte{
 	/* row 9 */
 	sdl.K_EQUALS:      0x3d,
@@ -112,6 +111,76 @@ var scancodes = map[sdl.Keycode]Byte{
 	sdl.K_EXCLAIM:   0x21, // !
 }
 
+// Function keys for the datasette buttons
+var tapeKeys = map[sdl.Keycode]TapeControl{
+	sdl.K_F5: TAPE_PLAY,
+	sdl.K_F6: TAPE_RECORD,
+	sdl.K_F7: TAPE_STOP,
+	sdl.K_F8: TAPE_REWIND,
+}
+
+// Game controller buttons which move a joystick
+var controllerButtons = map[uint8]Byte{
+	sdl.CONTROLLER_BUTTON_DPAD_UP:    JOY_UP,
+	sdl.CONTROLLER_BUTTON_DPAD_DOWN:  JOY_DOWN,
+	sdl.CONTROLLER_BUTTON_DPAD_LEFT:  JOY_LEFT,
+	sdl.CONTROLLER_BUTTON_DPAD_RIGHT: JOY_RIGHT,
+	sdl.CONTROLLER_BUTTON_A:          JOY_FIRE,
+	sdl.CONTROLLER_BUTTON_B:          JOY_FIRE,
+	sdl.CONTROLLER_BUTTON_X:          JOY_FIRE,
+	sdl.CONTROLLER_BUTTON_Y:          JOY_FIRE,
+}
+
+// A stick must move this far from the centre to move the joystick
+const CONTROLLER_DEAD_ZONE = 16384
+
+// joyKey is a key which moves a joystick
+type joyKey struct {
+	Joystick int  // Joystick number, from 0
+	Input    Byte // E.g. JOY_UP
+}
+
+// SetJoyKeys sets the keys for a joystick from a list of SDL key names for up,
+// down, left, right & fire E.g. "W,S,A,D,Space"
+func (g *GUI) SetJoyKeys(joystick int, list string) error {
+	names := strings.Split(list, ",")
+	if len(names) != len(joyInputs) {
+		return fmt.Errorf("joystick keys %q: expected keys for up, down, left, right & fire", list)
+	}
+	for n, name := range names {
+		key := sdl.GetKeyFromName(strings.TrimSpace(name))
+		if key == sdl.K_UNKNOWN {
+			return fmt.Errorf("joystick keys %q: unknown key %q", list, name)
+		}
+		if g.joyKeys == nil {
+			g.joyKeys = map[sdl.Keycode]joyKey{}
+		}
+		g.joyKeys[key] = joyKey{joystick, joyInputs[n].bit}
+	}
+	return nil
+}
+
+// joystickInput holds the inputs of a joystick from each host device, so that
+// releasing one doesn't cancel another
+type joystickInput struct {
+	keys    Byte // Keyboard
+	buttons Byte // Game controller buttons
+	stick   Byte // Game controller stick
+}
+
+func (j *joystickInput) state() Byte {
+	return j.keys | j.buttons | j.stick
+}
+
+// Key which switches between the window & full screen
+const FULLSCREEN_KEY = sdl.K_F11
+
+// Key which saves a screenshot
+const SCREENSHOT_KEY = sdl.K_F12
+
+// Key which reloads the character set
+const CHARSET_KEY = sdl.K_F9
+
 type Remapper struct {
 	runeToScan map[rune]Byte
 	remapped   map[Byte]Byte
@@ -166,64 +235,178 @@ func (r *Remapper) Up(scancode Byte) Byte {
 }
 
 type GUI struct {
-	Video *Video
+	Video      *Video
+	Display    *Display // Draws the frames
+	Joystick   bool     // Move the joysticks with game controllers & keys
+	Scale      int      // Size of each PET pixel in the window, in host pixels
+	Fullscreen bool     // Start in full screen
 
 	remapper *Remapper
 	window   *sdl.Window
+	renderer *sdl.Renderer
+	texture  *sdl.Texture // Framebuffer
+	width    int          // Current framebuffer width
+	height   int          // Current framebuffer height
+	image    *image.RGBA  // Image last drawn
+	stale    bool         // The window must be presented again
+
+	joyKeys     map[sdl.Keycode]joyKey // Keys which move the joysticks
+	joysticks   [JOYSTICKS]joystickInput
+	controllers map[sdl.JoystickID]*sdl.GameController // Open game controllers
+	controlled  map[sdl.JoystickID]int                 // Joystick each game controller moves
 }
 
 func (g *GUI) Init() error {
-	// Initialize SDL & create a window
-	err := sdl.Init(sdl.INIT_VIDEO)
+	// Initialize SDL & create a window. Game controllers are reported with
+	// CONTROLLERDEVICEADDED events, including those already connected.
+	flags := uint32(sdl.INIT_VIDEO)
+	if g.Joystick {
+		flags |= sdl.INIT_GAMECONTROLLER
+		g.controllers = map[sdl.JoystickID]*sdl.GameController{}
+		g.controlled = map[sdl.JoystickID]int{}
+	}
+	err := sdl.Init(flags)
 	if err != nil {
 		return err
 	}
 
+	if g.Scale < 1 {
+		g.Scale = 1
+	}
+
+	// The window size follows the video configuration. The CPU hasn't
+	// started, so it can be read directly.
+	g.width, g.height = g.Video.Size()
 	g.window, err = sdl.CreateWindow("pet",
 		sdl.WINDOWPOS_UNDEFINED,
 		sdl.WINDOWPOS_UNDEFINED,
-		windowHeight,
-		windowWidth,
-		sdl.WINDOW_SHOWN)
+		int32(g.width*g.Scale),
+		int32(g.height*g.Scale),
+		sdl.WINDOW_SHOWN|sdl.WINDOW_RESIZABLE)
 	if err != nil {
 		return err
 	}
 
+	// The framebuffer is scaled up by a whole number of pixels, with the
+	// presentation synchronised to the host display
+	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, "nearest")
+	g.renderer, err = sdl.CreateRenderer(g.window, -1, sdl.RENDERER_PRESENTVSYNC)
+	if err != nil {
+		return err
+	}
+	g.renderer.SetIntegerScale(true)
+	err = g.resize(g.width, g.height)
+	if err != nil {
+		return err
+	}
+
+	if g.Fullscreen {
+		g.window.SetFullscreen(sdl.WINDOW_FULLSCREEN_DESKTOP)
+	}
+
 	g.remapper = &Remapper{}
 	g.remapper.Init()
 
 	return nil
 }
 
-func (g *GUI) redraw() error {
-	surface, err := g.window.GetSurface()
+// resize creates a texture for a framebuffer of the given size
+func (g *GUI) resize(width, height int) error {
+	if g.texture != nil {
+		g.texture.Destroy()
+	}
+	var err error
+	g.texture, err = g.renderer.CreateTexture(sdl.PIXELFORMAT_RGBA32, sdl.TEXTUREACCESS_STREAMING, int32(width), int32(height))
 	if err != nil {
 		return err
 	}
+	g.width, g.height = width, height
+	return g.renderer.SetLogicalSize(int32(width), int32(height))
+}
+
+// toggleFullscreen switches between the window & the whole display
+func (g *GUI) toggleFullscreen() {
+	if g.window.GetFlags()&sdl.WINDOW_FULLSCREEN_DESKTOP == sdl.WINDOW_FULLSCREEN_DESKTOP {
+		g.window.SetFullscreen(0)
+	} else {
+		g.window.SetFullscreen(sdl.WINDOW_FULLSCREEN_DESKTOP)
+	}
+	g.stale = true
+}
+
+// screenshot saves the image on the screen to the next unused PNG file
+func (g *GUI) screenshot() {
+	if g.image == nil {
+		return
+	}
+	filename := screenshotName()
+	err := SavePNG(filename, g.image)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "screenshot: %s\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "screenshot: %s\n", filename)
+}
+
+// redraw renders the latest frame & presents it, & returns false if nothing
+// has changed & the window doesn't need to be presented again
+func (g *GUI) redraw() (bool, error) {
+	frame := g.Video.Frames.Front()
+	if frame != nil {
+		err := g.update(frame)
+		if err != nil {
+			return false, err
+		}
+	}
+	if !g.stale {
+		return false, nil
+	}
+	g.stale = false
 
-	// Clear the surface & lock it
-	surface.FillRect(nil, 0x0)
-	surface.Lock()
+	g.renderer.SetDrawColor(0, 0, 0, 0xff)
+	g.renderer.Clear()
+	g.renderer.Copy(g.texture, nil, nil)
+	g.renderer.Present()
 
-	// Perform video refresh
-	green := color.RGBA{G: uint8(180)}
+	return true, nil
+}
 
-	g.Video.Redraw(func(x, y int) {
-		surface.Set(x, y, green)
-	})
+// update renders a frame & uploads the area which has changed to the texture
+func (g *GUI) update(frame *Frame) error {
+	img, dirty := g.Display.Render(frame)
+	g.image = img
+	if dirty.Empty() {
+		return nil
+	}
 
-	// Unlock the surface & update the window
-	surface.Unlock()
-	g.window.UpdateSurface()
+	// Resize the window if the video configuration has changed. The image
+	// can be larger than the frame, to draw scan lines.
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if width != g.width || height != g.height {
+		err := g.resize(width, height)
+		if err != nil {
+			return err
+		}
+		frameWidth, _ := frame.Size()
+		scale := g.Scale * frameWidth / width
+		if scale < 1 {
+			scale = 1
+		}
+		g.window.SetSize(int32(width*scale), int32(height*scale))
+	}
 
+	// Upload the rows which have changed
+	rect := sdl.Rect{X: int32(dirty.Min.X), Y: int32(dirty.Min.Y), W: int32(dirty.Dx()), H: int32(dirty.Dy())}
+	err := g.texture.Update(&rect, unsafe.Pointer(&img.Pix[img.PixOffset(dirty.Min.X, dirty.Min.Y)]), img.Stride)
+	if err != nil {
+		return err
+	}
+	g.stale = true
 	return nil
 }
 
 // EventLoop handles any events generated by the GUI
 func (g *GUI) EventLoop(ctx context.Context, events chan<- Event) {
-	lastTicks := sdl.GetTicks()
-	currentTicks := lastTicks
-
 	for {
 		select {
 		case <-ctx.Done():
@@ -232,83 +415,243 @@ func (g *GUI) EventLoop(ctx context.Context, events chan<- Event) {
 			break
 		}
 
-		sdlEvent := sdl.PollEvent()
-		switch event := sdlEvent.(type) {
-		case *sdl.KeyboardEvent:
-			sym := event.Keysym.Sym
-			scancode, ok := scancodes[sym]
-			if !ok {
-				break
+		for sdlEvent := sdl.PollEvent(); sdlEvent != nil; sdlEvent = sdl.PollEvent() {
+			g.handleEvent(sdlEvent, events)
+		}
+
+		// Present the latest frame. Presenting waits for the host display's
+		// refresh, but if nothing has changed there is nothing to wait for.
+		presented, err := g.redraw()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gui: %s\n", err)
+			events <- EventQuit{}
+			return
+		}
+		if !presented {
+			sdl.Delay(5)
+		}
+	}
+}
+
+// handleEvent sends the events for an SDL event
+func (g *GUI) handleEvent(sdlEvent sdl.Event, events chan<- Event) {
+	switch event := sdlEvent.(type) {
+	case *sdl.WindowEvent:
+		// The window must be drawn again, even if the PET's screen hasn't
+		// changed
+		switch event.Event {
+		case sdl.WINDOWEVENT_EXPOSED, sdl.WINDOWEVENT_SIZE_CHANGED, sdl.WINDOWEVENT_RESTORED:
+			g.stale = true
+		}
+	case *sdl.KeyboardEvent:
+		sym := event.Keysym.Sym
+		if sym == FULLSCREEN_KEY {
+			if event.State == sdl.PRESSED {
+				g.toggleFullscreen()
 			}
-			k := Keypress{
-				Scancode: scancode,
+			break
+		}
+		if sym == SCREENSHOT_KEY {
+			if event.State == sdl.PRESSED {
+				g.screenshot()
 			}
-
-			/* fuck you SDL2 */
-			nextEvents := make([]sdl.Event, 10)
-			inChar := rune(0)
-
-			sdl.PumpEvents()
-			sdl.PeepEvents(nextEvents, sdl.GETEVENT, sdl.TEXTINPUT, sdl.TEXTINPUT)
-			nextEvent := nextEvents[0]
-			if nextEvent != nil {
-				inputEvent := nextEvent.(*sdl.TextInputEvent)
-				text := inputEvent.GetText()
-				inChar, _ = utf8.DecodeRuneInString(text[0:])
+			break
+		}
+		if sym == CHARSET_KEY {
+			if event.State == sdl.PRESSED {
+				events <- EventCharset{}
 			}
-
+			break
+		}
+		if control, ok := tapeKeys[sym]; ok {
 			if event.State == sdl.PRESSED {
-				// Lookup inChar and replace the scancode if we have a match
-				k.Scancode = g.remapper.Down(inChar, scancode)
-				k.State = KEY_DOWN
-			} else if event.State == sdl.RELEASED {
-				// If this scancode was remapped on KEY_DOWN then replace the scancode for KEY_UP
-				k.Scancode = g.remapper.Up(scancode)
-				k.State = KEY_UP
+				events <- EventTape{
+					Control: control,
+				}
 			}
-
-			// Some keys are shifted and we need to make that explicit
-			switch sym {
-			case sdl.K_UP,
-				sdl.K_LEFT,
-				sdl.K_LSHIFT,
-				sdl.K_RSHIFT:
-				k.Shifted = true
+			break
+		}
+		if key, ok := g.joyKeys[sym]; ok && g.Joystick {
+			input := &g.joysticks[key.Joystick]
+			if event.State == sdl.PRESSED {
+				input.keys |= key.Input
+			} else {
+				input.keys &^= key.Input
 			}
+			g.sendJoystick(events, key.Joystick)
+			break
+		}
+		scancode, ok := scancodes[sym]
+		if !ok {
+			break
+		}
+		k := Keypress{
+			Scancode: scancode,
+		}
 
-			// Send new key press event
-			events <- EventKeypress{
-				Key: k,
-			}
-		case *sdl.QuitEvent:
-			events <- EventQuit{}
+		/* fuck you SDL2 */
+		nextEvents := make([]sdl.Event, 10)
+		inChar := rune(0)
+
+		sdl.PumpEvents()
+		sdl.PeepEvents(nextEvents, sdl.GETEVENT, sdl.TEXTINPUT, sdl.TEXTINPUT)
+		nextEvent := nextEvents[0]
+		if nextEvent != nil {
+			inputEvent := nextEvent.(*sdl.TextInputEvent)
+			text := inputEvent.GetText()
+			inChar, _ = utf8.DecodeRuneInString(text[0:])
+		}
+
+		if event.State == sdl.PRESSED {
+			// Lookup inChar and replace the scancode if we have a match
+			k.Scancode = g.remapper.Down(inChar, scancode)
+			k.State = KEY_DOWN
+		} else if event.State == sdl.RELEASED {
+			// If this scancode was remapped on KEY_DOWN then replace the scancode for KEY_UP
+			k.Scancode = g.remapper.Up(scancode)
+			k.State = KEY_UP
 		}
 
-		// Wait 50ms and then redraw the screen
-		currentTicks = sdl.GetTicks()
-		if currentTicks > lastTicks+50 {
-			err := g.redraw()
-			if err != nil {
-				break
+		// Some keys are shifted and we need to make that explicit
+		switch sym {
+		case sdl.K_UP,
+			sdl.K_LEFT,
+			sdl.K_LSHIFT,
+			sdl.K_RSHIFT:
+			k.Shifted = true
+		}
+
+		// Send new key press event
+		events <- EventKeypress{
+			Key: k,
+		}
+	case *sdl.ControllerDeviceEvent:
+		g.controllerDevice(event, events)
+	case *sdl.ControllerButtonEvent:
+		joystick, ok := g.controlled[event.Which]
+		input, moves := controllerButtons[event.Button]
+		if !ok || !moves {
+			break
+		}
+		if event.State == sdl.PRESSED {
+			g.joysticks[joystick].buttons |= input
+		} else {
+			g.joysticks[joystick].buttons &^= input
+		}
+		g.sendJoystick(events, joystick)
+	case *sdl.ControllerAxisEvent:
+		joystick, ok := g.controlled[event.Which]
+		if !ok {
+			break
+		}
+		stick := &g.joysticks[joystick].stick
+		switch event.Axis {
+		case sdl.CONTROLLER_AXIS_LEFTX:
+			*stick = *stick&^(JOY_LEFT|JOY_RIGHT) | axisInput(event.Value, JOY_LEFT, JOY_RIGHT)
+		case sdl.CONTROLLER_AXIS_LEFTY:
+			*stick = *stick&^(JOY_UP|JOY_DOWN) | axisInput(event.Value, JOY_UP, JOY_DOWN)
+		}
+		g.sendJoystick(events, joystick)
+	case *sdl.QuitEvent:
+		events <- EventQuit{}
+	}
+}
+
+// controllerDevice opens game controllers as they are connected, & assigns
+// each to the first joystick which doesn't have one
+func (g *GUI) controllerDevice(event *sdl.ControllerDeviceEvent, events chan<- Event) {
+	switch event.Type {
+	case sdl.CONTROLLERDEVICEADDED:
+		// Which is the device index
+		for joystick := 0; joystick < JOYSTICKS; joystick++ {
+			if g.hasController(joystick) {
+				continue
 			}
+			controller := sdl.GameControllerOpen(int(event.Which))
+			if controller == nil {
+				return
+			}
+			id := controller.Joystick().InstanceID()
+			g.controllers[id] = controller
+			g.controlled[id] = joystick
+			fmt.Fprintf(os.Stderr, "joystick %d: %s\n", joystick+1, controller.Name())
+			return
+		}
+	case sdl.CONTROLLERDEVICEREMOVED:
+		// Which is the instance ID. Anything the controller held is released.
+		if controller, ok := g.controllers[event.Which]; ok {
+			joystick := g.controlled[event.Which]
+			controller.Close()
+			delete(g.controllers, event.Which)
+			delete(g.controlled, event.Which)
+			g.joysticks[joystick].buttons = 0
+			g.joysticks[joystick].stick = 0
+			g.sendJoystick(events, joystick)
+		}
+	}
+}
 
-			lastTicks = currentTicks
+// hasController returns true if a game controller moves the joystick
+func (g *GUI) hasController(joystick int) bool {
+	for _, j := range g.controlled {
+		if j == joystick {
+			return true
 		}
+	}
+	return false
+}
+
+// axisInput returns the joystick input for the position of a stick
+func axisInput(value int16, negative, positive Byte) Byte {
+	switch {
+	case value <= -CONTROLLER_DEAD_ZONE:
+		return negative
+	case value >= CONTROLLER_DEAD_ZONE:
+		return positive
+	}
+	return 0
+}
 
-		sdl.Delay(10)
+// sendJoystick sends the inputs of a joystick
+func (g *GUI) sendJoystick(events chan<- Event, joystick int) {
+	events <- EventJoystick{
+		Joystick: joystick,
+		State:    g.joysticks[joystick].state(),
 	}
 }
 
 func (g *GUI) Stop() {
+	for _, controller := range g.controllers {
+		controller.Close()
+	}
+	g.texture.Destroy()
+	g.renderer.Destroy()
 	g.window.Destroy()
 
 	sdl.Quit()
 }
 
-func (g *GUI) LoadDialog(title, filter, ext string) (string, error) {
-	return dialog.File().Filter(filter, ext).Title(title).Load()
+func (g *GUI) LoadDialog(title, filter string, ext ...string) (string, error) {
+	return dialog.File().Filter(filter, ext...).Title(title).Load()
 }
 
 func (g *GUI) SaveDialog(title, filter, ext string) (string, error) {
 	return dialog.File().Filter(filter, ext).Title(title).Save()
 }
+
+// ChooseDialog offers each item in turn & returns the index of the one which
+// is chosen
+func (g *GUI) ChooseDialog(title string, items []string) (int, error) {
+	for n, item := range items {
+		if dialog.Message("Load %s?", item).Title(title).YesNo() {
+			return n, nil
+		}
+	}
+	return 0, dialog.Cancelled
+}
+
+// ErrorDialog reports an error to the user. It can be used before the GUI
+// has been initialised.
+func ErrorDialog(title string, err error) {
+	dialog.Message("%s", err).Title(title).Error()
+}
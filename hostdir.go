@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Free blocks reported for a host directory; the host has plenty of space
+const HOST_BLOCKS_FREE = 65535
+
+// Host file extensions for each file type
+var hostExtensions = map[Byte]string{
+	FILE_SEQ: ".seq",
+	FILE_PRG: ".prg",
+	FILE_USR: ".usr",
+}
+
+/*
+HostDir is a directory on the host used as a disk. Each file in the directory
+with a .prg, .seq or .usr extension is a file on the disk E.g. LOAD"HELLO",8
+reads hello.prg. Letters in filenames are converted between PETSCII & ASCII,
+& any characters which can't be used in a host filename are written as %XX.
+
+The contents of SEQ files can optionally be converted between PETSCII & ASCII,
+so that they can be edited on the host.
+*/
+type HostDir struct {
+	Path  string // Host directory
+	ASCII bool   // Convert SEQ files between PETSCII & ASCII
+}
+
+// OpenHostDir checks that a directory exists & returns it as a disk
+func OpenHostDir(path string, ascii bool) (*HostDir, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", path)
+	}
+	return &HostDir{Path: path, ASCII: ascii}, nil
+}
+
+// hostName converts a PETSCII filename to a host filename
+func hostName(name []byte, fileType Byte) string {
+	var sb strings.Builder
+	for _, c := range name {
+		a := petsciiToASCII(c)
+		if a < 0x20 || a >= 0x7f || strings.IndexByte(`/\%:*?"<>|`, a) >= 0 {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(a)
+		}
+	}
+	return sb.String() + hostExtensions[fileType]
+}
+
+// petsciiName converts a host filename, without the extension, to a PETSCII
+// filename. ok is false if the name is not valid on the disk.
+func petsciiName(name string) ([]byte, bool) {
+	petscii := []byte{}
+	for n := 0; n < len(name); n++ {
+		c := name[n]
+		if c == '%' && n+2 < len(name) {
+			var b byte
+			_, err := fmt.Sscanf(name[n+1:n+3], "%02X", &b)
+			if err == nil {
+				petscii = append(petscii, b)
+				n += 2
+				continue
+			}
+		}
+		if c >= 0x80 {
+			return nil, false
+		}
+		petscii = append(petscii, asciiToPETSCII(c))
+	}
+	return petscii, len(petscii) > 0 && len(petscii) <= FILENAME_LEN
+}
+
+// DiskName returns the name of the directory
+func (h *HostDir) DiskName() []byte {
+	name := []byte{}
+	base := filepath.Base(h.Path)
+	if abs, err := filepath.Abs(h.Path); err == nil {
+		base = filepath.Base(abs)
+	}
+	base = strings.ToLower(base)
+	for n := 0; n < len(base) && len(name) < FILENAME_LEN; n++ {
+		name = append(name, asciiToPETSCII(base[n]))
+	}
+	for len(name) < FILENAME_LEN {
+		name = append(name, FILENAME_PAD)
+	}
+	return name
+}
+
+func (h *HostDir) DiskID() []byte {
+	return []byte{'H', 'D', FILENAME_PAD, '2', 'A'}
+}
+
+func (h *HostDir) DOS() string {
+	return "CBM DOS V2 HOST"
+}
+
+func (h *HostDir) BlocksFree() int {
+	return HOST_BLOCKS_FREE
+}
+
+func (h *HostDir) WriteProtected() bool {
+	return false
+}
+
+// Directory lists the files in the directory, in name order
+func (h *HostDir) Directory() ([]*DirEntry, error) {
+	files, err := os.ReadDir(h.Path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	entries := []*DirEntry{}
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		ext := filepath.Ext(file.Name())
+		for fileType, e := range hostExtensions {
+			if !strings.EqualFold(ext, e) {
+				continue
+			}
+			name, ok := petsciiName(strings.TrimSuffix(file.Name(), ext))
+			if !ok {
+				break
+			}
+			info, err := file.Info()
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, &DirEntry{
+				Type:     FILE_CLOSED | fileType,
+				Name:     name,
+				Blocks:   int((info.Size() + BLOCK_DATA - 1) / BLOCK_DATA),
+				hostPath: filepath.Join(h.Path, file.Name()),
+			})
+		}
+	}
+	return entries, nil
+}
+
+func (h *HostDir) ReadFile(e *DirEntry) ([]byte, error) {
+	data, err := os.ReadFile(e.hostPath)
+	if err != nil {
+		return nil, hostError(err)
+	}
+	if h.ASCII && e.Type&FILE_TYPE == FILE_SEQ {
+		for n, c := range data {
+			data[n] = asciiToPETSCII(c)
+		}
+	}
+	return data, nil
+}
+
+func (h *HostDir) WriteFile(name []byte, fileType Byte, data []byte) error {
+	if _, ok := hostExtensions[fileType]; !ok {
+		return dosError(DOS_TYPE_MISMATCH)
+	}
+	if h.ASCII && fileType == FILE_SEQ {
+		// BASIC 2 sends CR LF at the end of each line
+		ascii := make([]byte, 0, len(data))
+		for n, c := range data {
+			if c == '\n' && n > 0 && data[n-1] == '\r' {
+				continue
+			}
+			ascii = append(ascii, petsciiToASCII(c))
+		}
+		data = ascii
+	}
+
+	// The file is written under a temporary name & renamed, so that a file
+	// it replaces isn't lost if it can't be written
+	file, err := os.CreateTemp(h.Path, ".pet-*")
+	if err != nil {
+		return hostError(err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(h.Path, hostName(name, fileType)))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return hostError(err)
+}
+
+// overwrites returns true if writing a file replaces an entry in place, as
+// they are the same host file
+func (h *HostDir) overwrites(e *DirEntry, name []byte, fileType Byte) bool {
+	old, err := os.Stat(e.hostPath)
+	if err != nil {
+		return false
+	}
+	written, err := os.Stat(filepath.Join(h.Path, hostName(name, fileType)))
+	return err == nil && os.SameFile(old, written)
+}
+
+func (h *HostDir) Scratch(e *DirEntry) error {
+	return hostError(os.Remove(e.hostPath))
+}
+
+func (h *HostDir) Rename(e *DirEntry, name []byte) error {
+	path := filepath.Join(h.Path, hostName(name, e.Type&FILE_TYPE))
+	return hostError(os.Rename(e.hostPath, path))
+}
+
+// Validate does nothing; there is no BAM
+func (h *HostDir) Validate() error {
+	return nil
+}
+
+// Save does nothing; files are written as soon as they're closed
+func (h *HostDir) Save() error {
+	return nil
+}
+
+// hostError converts errors from the host to DOS errors
+func hostError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return dosError(DOS_FILE_NOT_FOUND)
+	case errors.Is(err, fs.ErrPermission):
+		return dosError(DOS_WRITE_PROTECT)
+	}
+	return err
+}
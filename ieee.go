@@ -0,0 +1,373 @@
+package main
+
+import "fmt"
+
+// IEEE-488 command bytes, sent by the controller while ATN is asserted
+const (
+	IEEE_LISTEN   = 0x20 // Listen, plus the primary address
+	IEEE_UNLISTEN = 0x3f // Unlisten all devices
+	IEEE_TALK     = 0x40 // Talk, plus the primary address
+	IEEE_UNTALK   = 0x5f // Untalk all devices
+	IEEE_DATA     = 0x60 // Secondary address: data channel
+	IEEE_CLOSE    = 0xe0 // Secondary address: close channel
+	IEEE_OPEN     = 0xf0 // Secondary address: open channel
+
+	// Passed to Listen & Talk when no secondary address was sent
+	IEEE_NO_SECONDARY = 0x00
+
+	// Range of primary addresses available to devices
+	IEEE_MIN_ADDRESS = 4
+	IEEE_MAX_ADDRESS = 30
+
+	// Cycles before a talker responds to the listeners being ready
+	IEEE_TALK_DELAY = 20
+)
+
+/*
+IEEEDevice is implemented by emulated devices on the IEEE-488 bus. The bus
+handles the handshake; the device is told when it is addressed & then sends
+or receives a byte at a time.
+*/
+type IEEEDevice interface {
+	// Listen is called when the device is addressed to listen. The secondary
+	// address is IEEE_DATA, IEEE_CLOSE or IEEE_OPEN plus the channel, or
+	// IEEE_NO_SECONDARY.
+	Listen(secondary Byte)
+	// Unlisten is called when the device is no longer a listener
+	Unlisten()
+	// Talk is called when the device is addressed to talk
+	Talk(secondary Byte)
+	// Untalk is called when the device is no longer the talker
+	Untalk()
+	// Receive is called with each byte sent to the device while it is a
+	// listener. eoi is true for the last byte.
+	Receive(data Byte, eoi bool)
+	// Send is called for each byte while the device is the talker. ok is
+	// false if the device has nothing to send.
+	Send() (data Byte, eoi bool, ok bool)
+}
+
+// ieeeLines holds the state of the bus lines driven by one side of the bus.
+// Each line is true when it is asserted (pulled low).
+type ieeeLines struct {
+	atn  bool // Attention
+	dav  bool // Data valid
+	nrfd bool // Not ready for data
+	ndac bool // Not data accepted
+	eoi  bool // End or identify
+	srq  bool // Service request
+	data Byte // Data lines
+}
+
+// ieeeHeld is a byte which was interrupted by ATN before the listeners
+// accepted it. It is sent again the next time the channel talks.
+type ieeeHeld struct {
+	talker    Byte
+	secondary Byte
+	data      Byte
+	eoi       bool
+}
+
+/*
+IEEEBus models the IEEE-488 bus, with the PET as the controller. The lines are
+open collector, so a line is asserted if either the PET or any of the devices
+asserts it. The devices respond to the handshake as soon as the PET changes a
+line, except that a talker waits for the listeners to be ready for
+IEEE_TALK_DELAY cycles before it sends a byte; the PET briefly looks ready
+when it releases NRFD & NDAC before sending a command.
+*/
+type IEEEBus struct {
+	devices map[Byte]IEEEDevice
+
+	pet ieeeLines // Lines driven by the PET
+	dev ieeeLines // Lines driven by the devices
+
+	attention bool            // Devices have seen ATN
+	accepted  bool            // The current byte has been accepted
+	listeners map[Byte]bool   // Addressed listeners
+	talker    Byte            // Addressed talker
+	talkSA    Byte            // Secondary address of the talker
+	held      *ieeeHeld       // Byte which was sent but not accepted
+	ready     int             // Cycles the listeners have been ready for
+	talking   bool            // A device is the active talker
+	secondary func(Byte)      // Function to handle the secondary address
+	pending   map[Byte]func() // Devices still waiting for a secondary address
+}
+
+// Attach a device to the bus at the given primary address
+func (b *IEEEBus) Attach(address Byte, device IEEEDevice) error {
+	if address < IEEE_MIN_ADDRESS || address > IEEE_MAX_ADDRESS {
+		return fmt.Errorf("invalid IEEE-488 device address %d", address)
+	}
+	if b.devices == nil {
+		b.devices = make(map[Byte]IEEEDevice)
+	}
+	if _, ok := b.devices[address]; ok {
+		return fmt.Errorf("IEEE-488 device address %d is already in use", address)
+	}
+	b.devices[address] = device
+	return nil
+}
+
+// Device returns the device at the given primary address, or nil
+func (b *IEEEBus) Device(address Byte) IEEEDevice {
+	return b.devices[address]
+}
+
+// Functions to set the lines driven by the PET
+
+func (b *IEEEBus) SetATN(asserted bool) {
+	b.pet.atn = asserted
+	b.update()
+}
+
+func (b *IEEEBus) SetDAV(asserted bool) {
+	b.pet.dav = asserted
+	b.update()
+}
+
+func (b *IEEEBus) SetNRFD(asserted bool) {
+	b.pet.nrfd = asserted
+	b.update()
+}
+
+func (b *IEEEBus) SetNDAC(asserted bool) {
+	b.pet.ndac = asserted
+	b.update()
+}
+
+func (b *IEEEBus) SetEOI(asserted bool) {
+	b.pet.eoi = asserted
+	b.update()
+}
+
+func (b *IEEEBus) SetData(data Byte) {
+	b.pet.data = data
+	b.update()
+}
+
+// Functions to read the state of the bus lines
+
+func (b *IEEEBus) ATN() bool {
+	return b.pet.atn || b.dev.atn
+}
+
+func (b *IEEEBus) DAV() bool {
+	return b.pet.dav || b.dev.dav
+}
+
+func (b *IEEEBus) NRFD() bool {
+	return b.pet.nrfd || b.dev.nrfd
+}
+
+func (b *IEEEBus) NDAC() bool {
+	return b.pet.ndac || b.dev.ndac
+}
+
+func (b *IEEEBus) EOI() bool {
+	return b.pet.eoi || b.dev.eoi
+}
+
+func (b *IEEEBus) SRQ() bool {
+	return b.pet.srq || b.dev.srq
+}
+
+func (b *IEEEBus) Data() Byte {
+	return b.pet.data | b.dev.data
+}
+
+// update runs the device side of the handshake after a line has changed
+func (b *IEEEBus) update() {
+	if len(b.devices) == 0 {
+		return
+	}
+
+	if b.pet.atn {
+		if !b.attention {
+			// All devices must listen for commands. Stop talking
+			// & accept the command bytes.
+			b.attention = true
+			if b.talking && b.dev.dav {
+				b.held = &ieeeHeld{b.talker, b.talkSA, b.dev.data, b.dev.eoi}
+			}
+			b.talking = false
+			b.dev = ieeeLines{ndac: true}
+			b.accepted = false
+		}
+		b.accept(true)
+		return
+	}
+
+	if b.attention {
+		// End of commands; anything waiting for a secondary address
+		// doesn't get one
+		b.attention = false
+		for _, f := range b.pending {
+			f()
+		}
+		b.pending = nil
+
+		switch {
+		case b.talker != 0:
+			// Turn around to become the talker
+			b.talking = true
+			b.dev = ieeeLines{}
+		case len(b.listeners) > 0:
+			b.dev = ieeeLines{ndac: true}
+		default:
+			// Nobody is addressed; release the bus
+			b.dev = ieeeLines{}
+		}
+		b.accepted = false
+	}
+
+	switch {
+	case b.talking:
+		b.source()
+	case len(b.listeners) > 0:
+		b.accept(false)
+	}
+}
+
+// Tick advances any devices which keep time, & runs the talker once the
+// listeners are ready
+func (b *IEEEBus) Tick(cycles int) {
+	for _, device := range b.devices {
+		if t, ok := device.(Ticker); ok {
+			t.Tick(cycles)
+		}
+	}
+
+	if !b.talking || b.dev.dav {
+		return
+	}
+	if b.pet.nrfd || !b.pet.ndac {
+		b.ready = 0
+		return
+	}
+	b.ready += cycles
+	if b.ready >= IEEE_TALK_DELAY {
+		b.ready = 0
+		b.send()
+	}
+}
+
+// accept runs the acceptor handshake for the listeners
+func (b *IEEEBus) accept(command bool) {
+	if b.pet.dav && !b.accepted {
+		data := b.Data()
+		eoi := b.EOI()
+
+		// Busy, until the data is handled
+		b.dev.nrfd = true
+		if command {
+			b.command(data)
+		} else {
+			for address := range b.listeners {
+				b.devices[address].Receive(data, eoi)
+			}
+		}
+		b.dev.ndac = false
+		b.accepted = true
+	} else if !b.pet.dav && b.accepted {
+		// Ready for the next byte
+		b.accepted = false
+		b.dev.ndac = true
+		b.dev.nrfd = false
+	}
+}
+
+// source runs the source handshake for the talker. The next byte is sent
+// by Tick.
+func (b *IEEEBus) source() {
+	if b.dev.dav && !b.pet.ndac {
+		// Data accepted
+		b.dev.dav = false
+		b.dev.eoi = false
+		b.dev.data = 0x00
+	}
+}
+
+// send puts the next byte from the talker on the bus
+func (b *IEEEBus) send() {
+	var (
+		data Byte
+		eoi  bool
+		ok   bool
+	)
+	if h := b.held; h != nil && h.talker == b.talker && h.secondary == b.talkSA {
+		data, eoi, ok = h.data, h.eoi, true
+	} else {
+		data, eoi, ok = b.devices[b.talker].Send()
+	}
+	b.held = nil
+	if !ok {
+		return
+	}
+	b.dev.data = data
+	b.dev.eoi = eoi
+	b.dev.dav = true
+}
+
+// command handles a command byte sent with ATN asserted
+func (b *IEEEBus) command(cmd Byte) {
+	switch {
+	case cmd == IEEE_UNLISTEN:
+		for address := range b.listeners {
+			b.devices[address].Unlisten()
+		}
+		b.listeners = nil
+		b.secondary = nil
+	case cmd == IEEE_UNTALK:
+		if b.talker != 0 {
+			b.devices[b.talker].Untalk()
+		}
+		b.talker = 0
+		b.secondary = nil
+	case cmd&0xe0 == IEEE_LISTEN:
+		address := cmd & 0x1f
+		device, ok := b.devices[address]
+		if !ok {
+			b.secondary = nil
+			break
+		}
+		if b.listeners == nil {
+			b.listeners = make(map[Byte]bool)
+		}
+		b.listeners[address] = true
+		b.expectSecondary(address, device.Listen)
+	case cmd&0xe0 == IEEE_TALK:
+		address := cmd & 0x1f
+		device, ok := b.devices[address]
+		if !ok {
+			b.secondary = nil
+			break
+		}
+		b.talker = address
+		b.expectSecondary(address, func(sa Byte) {
+			b.talkSA = sa
+			device.Talk(sa)
+		})
+	case cmd&0xe0 == IEEE_DATA, cmd&0xe0 == IEEE_CLOSE, cmd&0xe0 == IEEE_OPEN:
+		if b.secondary != nil {
+			b.secondary(cmd)
+			b.secondary = nil
+		}
+	}
+}
+
+// expectSecondary arranges for the next secondary address to be passed to f.
+// If no secondary address is sent, f is called with IEEE_NO_SECONDARY
+// at the end of the commands.
+func (b *IEEEBus) expectSecondary(address Byte, f func(Byte)) {
+	if b.pending == nil {
+		b.pending = make(map[Byte]func())
+	}
+	b.pending[address] = func() {
+		f(IEEE_NO_SECONDARY)
+	}
+	b.secondary = func(sa Byte) {
+		delete(b.pending, address)
+		f(sa)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Joystick directions & fire button, as sent in EventJoystick
+const (
+	JOY_UP    = 0x01
+	JOY_DOWN  = 0x02
+	JOY_LEFT  = 0x04
+	JOY_RIGHT = 0x08
+	JOY_FIRE  = 0x10
+)
+
+// Number of joysticks on the adapter
+const JOYSTICKS = 2
+
+// Names of the joystick inputs, for keys & scripts
+var joyInputs = []struct {
+	name string
+	bit  Byte
+}{
+	{"up", JOY_UP},
+	{"down", JOY_DOWN},
+	{"left", JOY_LEFT},
+	{"right", JOY_RIGHT},
+	{"fire", JOY_FIRE},
+}
+
+/*
+UserPortJoystick is the common dual joystick adapter, which connects the
+switches of two joysticks to the user port data lines. Joystick 1 is on PA0-PA3
+& joystick 2 on PA4-PA7, with up, down, left & right in that order. A line is
+low while its switch is closed. There are no spare lines for the fire buttons,
+so fire closes both the left & right switches, which a joystick can't do.
+*/
+type UserPortJoystick struct {
+	state [JOYSTICKS]Byte // Inputs of each joystick E.g. JOY_UP|JOY_FIRE
+}
+
+// Set sets the inputs of a joystick, numbered from 0
+func (j *UserPortJoystick) Set(joystick int, state Byte) {
+	if joystick >= 0 && joystick < JOYSTICKS {
+		j.state[joystick] = state
+	}
+}
+
+func (j *UserPortJoystick) Read() Byte {
+	lines := Byte(0)
+	for n, state := range j.state {
+		if state&JOY_FIRE != 0 {
+			state |= JOY_LEFT | JOY_RIGHT
+		}
+		lines |= (state & 0x0f) << (4 * n)
+	}
+	return ^lines
+}
+
+func (j *UserPortJoystick) Write(data Byte) {
+}
+
+func (j *UserPortJoystick) CB2(level bool) {
+}
+
+func (j *UserPortJoystick) Tick(cycles int) {
+}
+
+// parseJoyInputs returns the inputs in a list such as "up+fire". "none" is
+// no inputs.
+func parseJoyInputs(list string) (Byte, error) {
+	state := Byte(0)
+	if list == "none" {
+		return state, nil
+	}
+	for _, name := range strings.Split(list, "+") {
+		found := false
+		for _, input := range joyInputs {
+			if name == input.name {
+				state |= input.bit
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown joystick input %q", name)
+		}
+	}
+	return state, nil
+}
+
+// joyEvent sets the inputs of a joystick at a time in emulated time
+type joyEvent struct {
+	cycle    uint64
+	joystick int
+	state    Byte
+}
+
+/*
+JoystickScript plays a list of joystick events in emulated time, so that a
+test sees the same inputs at the same point on every run. Each line of the
+script is the time since the PET was started, the joystick number & the
+inputs which are held from then on E.g.
+
+	# Walk right, then jump
+	2s    1 right
+	2.5s  1 right+fire
+	3s    1 none
+
+Blank lines & lines starting with # are ignored.
+*/
+type JoystickScript struct {
+	events []joyEvent
+	next   int
+}
+
+// LoadJoystickScript reads a script from a file
+func LoadJoystickScript(filename string) (*JoystickScript, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	s := &JoystickScript{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected time, joystick & inputs", filename, line)
+		}
+		at, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		joystick, err := strconv.Atoi(fields[1])
+		if err != nil || joystick < 1 || joystick > JOYSTICKS {
+			return nil, fmt.Errorf("%s:%d: invalid joystick %q", filename, line, fields[1])
+		}
+		state, err := parseJoyInputs(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+
+		cycle := uint64(at.Seconds() * CPU_CLOCK)
+		if len(s.events) > 0 && cycle < s.events[len(s.events)-1].cycle {
+			return nil, fmt.Errorf("%s:%d: events must be in time order", filename, line)
+		}
+		s.events = append(s.events, joyEvent{cycle, joystick - 1, state})
+	}
+	return s, scanner.Err()
+}
+
+// Play sets the inputs of every event which is due at the given cycle
+func (s *JoystickScript) Play(cycle uint64, joy *UserPortJoystick) {
+	for s.next < len(s.events) && s.events[s.next].cycle <= cycle {
+		e := s.events[s.next]
+		joy.Set(e.joystick, e.state)
+		s.next++
+	}
+}
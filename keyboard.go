@@ -51,8 +51,6 @@ func (m *Matrix) Get(row uint8) Byte {
 }
 
 type Keyboard struct {
-	Buffer chan<- (Key) // Keyboard "buffer"
-
 	matrix Matrix // Keyboard scan matrix
 	keys   map[Byte]Key
 }
@@ -155,8 +153,6 @@ func (kbd *Keyboard) Reset() {
 func (kbd *Keyboard) Scan(k Keypress) {
 	key, ok := kbd.keys[k.Scancode]
 	if ok {
-		kbd.Buffer <- key
-
 		switch k.State {
 		case KEY_DOWN:
 			kbd.matrix.Set(key.row, key.bit)
@@ -8,7 +8,6 @@ import (
 	"os"
 	"sync"
 
-	"github.com/sqweek/dialog"
 	"github.com/vanders/pet/mos6502"
 )
 
@@ -43,6 +42,27 @@ func dump(cpu *mos6502.CPU, ram *RAM) {
 	}
 }
 
+// Errors are also shown in a dialog, if the GUI will run
+var errorDialogs = false
+
+// fatal reports an error on stderr, & in a dialog if errorDialogs is set, then
+// exits
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "pet: %s\n", err)
+	if errorDialogs {
+		ErrorDialog("pet", err)
+	}
+	os.Exit(1)
+}
+
+// mustLoad loads a ROM image from the ROM set & exits if it can't be loaded
+func mustLoad(roms *ROMSet, rom *ROM, filename string) {
+	err := roms.Load(rom, filename)
+	if err != nil {
+		fatal(err)
+	}
+}
+
 type PET struct {
 	cpu  *mos6502.CPU
 	bus  *Bus
@@ -50,10 +70,11 @@ type PET struct {
 	pia1 *PIA1
 	pia2 *PIA2
 	via  *VIA
+	ieee *IEEEBus
 
 	cassette *Cassette
 
-	gui *GUI
+	gui *GUI // GUI, or nil without a window
 
 	mos6502.WordReadWrite
 }
@@ -70,6 +91,14 @@ const (
 	// Zero page
 	TXTTAB = 0x28
 	VARTAB = 0x2a
+	STATUS = 0x96 // I/O status
+	VERCK  = 0x9d // LOAD (0) or VERIFY (1)
+	EAL    = 0xc9 // End address for SAVE, plus one
+	FNLEN  = 0xd1 // Length of the filename
+	SA     = 0xd3 // Secondary address
+	FA     = 0xd4 // Device number
+	FNADR  = 0xda // Address of the filename
+	STAL   = 0xfb // Start address for SAVE
 )
 
 func main() {
@@ -82,22 +111,107 @@ func main() {
 
 	debug := flag.Bool("d", false, "enable CPU dissasembly")
 	romVersion := flag.Int("r", 2, "ROM version (2 or 4)")
-	ramSize := flag.Int("m", 32, "RAM size (Megabytes)")
+	ramSize := flag.Int("m", 32, "RAM size (Kilobytes, 96 or 128 for the 8096/8296 expansion)")
+	columns := flag.Int("c", 40, "screen columns (40 or 80, ROM version 4 only)")
+	rom9 := flag.String("rom9", "", "expansion ROM image for the $9000 socket")
+	romA := flag.String("romA", "", "expansion ROM image for the $A000 socket")
+	charset := flag.String("charset", "", "character ROM: "+charsetNames()+", or a ROM image file (default is the model's; F9 reloads it)")
+	romdir := flag.String("romdir", "", "directory to search for ROM images (see also $"+ENV_ROMDIR+")")
+	config := flag.String("config", defaultConfig(), "configuration file")
+	soundOn := flag.Bool("sound", false, "play sound (the emulator runs at the speed of a real PET)")
+	wavFile := flag.String("wav", "", "write sound to a WAV file")
+	headless := flag.Bool("headless", false, "run without a window")
+	scale := flag.Int("scale", 2, "size of each PET pixel in the window, in screen pixels")
+	fullscreen := flag.Bool("fullscreen", false, "start in full screen (F11 switches)")
+	phosphor := flag.String("phosphor", CRT_PHOSPHOR, "display colour: green, white, amber or #rrggbb")
+	scanlines := flag.Float64("scanlines", 0, "darken the gaps between scan lines, from 0 to 1")
+	persistence := flag.Float64("persistence", 0, "afterglow of the phosphor between frames, from 0 to 1")
+	bloom := flag.Float64("bloom", 0, "glow around lit pixels, from 0 to 1")
+	recordFile := flag.String("record", "", "record the display to an animated GIF (.gif) or a stream of PPM images, in step with -wav")
+	screenshotFile := flag.String("screenshot", "", "save the display to a PNG image on exit")
+	printScreen := flag.String("printscreen", "", "print the screen text on exit, rather than the zero page: \"text\", or \"ansi\" to show reverse video")
+	runTime := flag.Duration("t", 0, "stop after the given emulated time E.g. 10s")
+	drive8 := flag.String("drive8", "", "D64, D80 or D82 disk image or host directory for drive 8")
+	drive9 := flag.String("drive9", "", "D64, D80 or D82 disk image or host directory for drive 9")
+	seqASCII := flag.Bool("seqascii", false, "convert SEQ files in host directories between PETSCII & ASCII")
+	printerBase := flag.String("printer", "", "emulate a printer on device 4, writing each job to <printer>-NNN.txt")
+	printerPNG := flag.Bool("printerpng", false, "also write printer pages to PNG images")
+	traps := flag.Bool("traps", true, "trap LOAD & SAVE (false runs the unmodified kernal, for IEEE-488 devices)")
+	tapFile := flag.String("tap", "", "TAP image or WAV file for the datasette, created if it doesn't exist (implies -traps=false)")
+	prgDir := flag.String("prgdir", "", "directory of PRG & T64 files for LOAD & SAVE on the cassette devices, rather than a dialog")
+	t64List := flag.String("t64list", "", "list the files in a T64 archive & exit")
+	t64Extract := flag.String("t64extract", "", "extract the files in a T64 archive to PRG files in the current directory & exit")
+	wavThreshold := flag.Float64("wavthreshold", WAV_THRESHOLD, "level a WAV tape must pass to switch, as a fraction of full scale")
+	wavTolerance := flag.Float64("wavtolerance", WAV_TOLERANCE, "largest speed correction for a WAV tape, as a fraction (0 disables it)")
+	wavInvert := flag.Bool("wavinvert", false, "invert the signal of a WAV tape")
+	userPortDevice := flag.String("userport", "", "device on the user port: \"printer:<file>\", \"loopback\" or \"joystick\"")
+	joyKeys1 := flag.String("joykeys1", "", "keys for joystick 1 up, down, left, right & fire E.g. \"W,S,A,D,Left Ctrl\"")
+	joyKeys2 := flag.String("joykeys2", "", "keys for joystick 2 up, down, left, right & fire")
+	joyScript := flag.String("joyscript", "", "play joystick events from a file, at the emulated times given")
+	tapeButton := flag.String("tapebutton", "", "press \"play\" or \"record\" on the datasette at start E.g. with -headless")
 	flag.Parse()
 
+	// Flags given on the command line override the configuration file
+	if *config != "" {
+		err := loadConfig(*config, flag.CommandLine)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if *debug {
 		writer = os.Stderr
 	}
 
+	// Without a window there may be no display to show a dialog on
+	errorDialogs = !*headless
+
+	// T64 archive tools
+	if *t64List != "" || *t64Extract != "" {
+		err := t64Tool(*t64List, *t64Extract)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// The datasette is driven by the kernal's own tape routines
+	if *tapFile != "" {
+		*traps = false
+	}
+
+	// ROM images are found through the ROM set search path
+	roms := NewROMSet(*romdir, os.Stderr)
+
 	// Create a new memory bus
 	bus := Bus{}
 
 	// Initialise memory
 
-	// Main memory
+	// Main memory. The 8096 & 8296 have 32k of main memory plus a 64k
+	// expansion which is mapped in once all of the other devices are
+	var banked *BankedRAM
+
+	mainSize := *ramSize
+	if *ramSize == 96 || *ramSize == 128 {
+		if *columns != 80 {
+			fmt.Fprintf(os.Stderr, "RAM size %d requires 80 columns\n", *ramSize)
+			os.Exit(1)
+		}
+		mainSize = 32
+
+		banked = &BankedRAM{
+			Base: 0x8000,
+			Size: 0x8000, // 32k window over 64k
+		}
+		banked.Reset()
+	}
+
 	ram := &RAM{
 		Base: 0x0000,
-		Size: Word(*ramSize * 1024), // 0x7fff, // 32k
+		Size: Word(mainSize * 1024), // 0x7fff, // 32k
 	}
 	ram.Reset()
 	bus.Map(ram)
@@ -110,6 +224,14 @@ func main() {
 	sram.Reset()
 	bus.Map(sram)
 
+	// CRT controller; only fitted to machines with BASIC 4
+	var crtc *CRTC
+
+	if *columns != 40 && (*columns != 80 || *romVersion != 4) {
+		fmt.Fprintf(os.Stderr, "Invalid screen columns %d for ROM version %d\n", *columns, *romVersion)
+		os.Exit(1)
+	}
+
 	// Load ROMs
 	switch *romVersion {
 	case 0: // Special case for diagnostic ROMs
@@ -118,7 +240,7 @@ func main() {
 			Size: 0x800, // 2k
 		}
 		u2.Reset()
-		u2.Load("roms/U-2 DIA")
+		mustLoad(roms, u2, "U-2 DIA")
 		bus.Map(u2)
 
 		u3 := &ROM{
@@ -126,7 +248,7 @@ func main() {
 			Size: 0x800, // 2k
 		}
 		u3.Reset()
-		u3.Load("roms/U-3 DIA")
+		mustLoad(roms, u3, "U-3 DIA")
 		bus.Map(u3)
 	case 2:
 		basicLo := &ROM{
@@ -134,7 +256,7 @@ func main() {
 			Size: 0x1000, // 4k
 		}
 		basicLo.Reset()
-		basicLo.Load("roms/basic-2-c000.901465-01.bin")
+		mustLoad(roms, basicLo, "basic-2-c000.901465-01.bin")
 		bus.Map(basicLo)
 
 		basicHi := &ROM{
@@ -142,7 +264,7 @@ func main() {
 			Size: 0x1000, // 4k
 		}
 		basicHi.Reset()
-		basicHi.Load("roms/basic-2-d000.901465-02.bin")
+		mustLoad(roms, basicHi, "basic-2-d000.901465-02.bin")
 		bus.Map(basicHi)
 
 		edit := &ROM{
@@ -150,7 +272,7 @@ func main() {
 			Size: 0x800, // 2k
 		}
 		edit.Reset()
-		edit.Load("roms/edit-2-n.901447-24.bin")
+		mustLoad(roms, edit, "edit-2-n.901447-24.bin")
 		bus.Map(edit)
 
 		kernal := &ROM{
@@ -158,9 +280,11 @@ func main() {
 			Size: 0x1000, // 4k
 		}
 		kernal.Reset()
-		kernal.Load("roms/kernal-2.901465-03.bin")
-		kernal.PatchVector(VEC_LOAD, LOADPATCH_v2)
-		kernal.PatchVector(VEC_SAVE, SAVEPATCH_v2)
+		mustLoad(roms, kernal, "kernal-2.901465-03.bin")
+		if *traps {
+			kernal.PatchVector(VEC_LOAD, LOADPATCH_v2)
+			kernal.PatchVector(VEC_SAVE, SAVEPATCH_v2)
+		}
 		bus.Map(kernal)
 	case 4:
 		basic1 := &ROM{
@@ -168,7 +292,7 @@ func main() {
 			Size: 0x1000, // 4k
 		}
 		basic1.Reset()
-		basic1.Load("roms/basic-4-b000.901465-23.bin")
+		mustLoad(roms, basic1, "basic-4-b000.901465-23.bin")
 		bus.Map(basic1)
 
 		basic2 := &ROM{
@@ -176,7 +300,7 @@ func main() {
 			Size: 0x1000, // 4k
 		}
 		basic2.Reset()
-		basic2.Load("roms/basic-4-c000.901465-20.bin")
+		mustLoad(roms, basic2, "basic-4-c000.901465-20.bin")
 		bus.Map(basic2)
 
 		basic3 := &ROM{
@@ -184,7 +308,7 @@ func main() {
 			Size: 0x1000, // 4k
 		}
 		basic3.Reset()
-		basic3.Load("roms/basic-4-d000.901465-21.bin")
+		mustLoad(roms, basic3, "basic-4-d000.901465-21.bin")
 		bus.Map(basic3)
 
 		edit := &ROM{
@@ -192,7 +316,17 @@ func main() {
 			Size: 0x800, // 2k
 		}
 		edit.Reset()
-		edit.Load("roms/edit-4-40-n-50Hz.901498-01.bin")
+		if *columns == 80 {
+			// The 80 column editor isn't built in, so it must be supplied
+			if _, _, err := roms.Find(EDITOR_80_COLUMNS); err != nil {
+				fatal(fmt.Errorf("80 columns requires the 80 column editor ROM %s, which isn't built in: copy it to a ROM directory (see -romdir)", EDITOR_80_COLUMNS))
+			}
+			mustLoad(roms, edit, EDITOR_80_COLUMNS)
+		} else {
+			// The 40 column BASIC 4 editor of the 4032 with a CRTC ("fat
+			// 40"), which programs the CRTC for 50Hz
+			mustLoad(roms, edit, "edit-4-40-n-50Hz.901498-01.bin")
+		}
 		bus.Map(edit)
 
 		kernal := &ROM{
@@ -200,85 +334,299 @@ func main() {
 			Size: 0x1000, // 4k
 		}
 		kernal.Reset()
-		kernal.Load("roms/kernal-4.901465-22.bin")
-		kernal.PatchVector(VEC_LOAD, LOADPATCH_v4)
-		kernal.PatchVector(VEC_SAVE, SAVEPATCH_v4)
+		mustLoad(roms, kernal, "kernal-4.901465-22.bin")
+		if *traps {
+			kernal.PatchVector(VEC_LOAD, LOADPATCH_v4)
+			kernal.PatchVector(VEC_SAVE, SAVEPATCH_v4)
+		}
 		bus.Map(kernal)
+
+		crtc = &CRTC{
+			Base: 0xe880,
+		}
+		crtc.Reset()
+		bus.Map(crtc)
 	default:
 		fmt.Fprintf(os.Stderr, "Invalid ROM version %d\n", *romVersion)
 		os.Exit(1)
 	}
 
-	// Configure keyboard
-	buf := make(chan Key, 1)
-	kbd := &Keyboard{
-		Buffer: buf,
+	// Expansion ROMs
+	if *rom9 != "" {
+		exp9 := &ROM{
+			Base: 0x9000,
+			Size: 0x1000, // 4k
+		}
+		exp9.Reset()
+		mustLoad(roms, exp9, *rom9)
+		bus.Map(exp9)
+	}
+
+	if *romA != "" {
+		expA := &ROM{
+			Base: 0xa000,
+			Size: 0x1000, // 4k
+		}
+		expA.Reset()
+		mustLoad(roms, expA, *romA)
+		bus.Map(expA)
 	}
+
+	// Configure keyboard
+	kbd := &Keyboard{}
 	kbd.Reset()
 
+	// IEEE-488 bus. Devices are attached with ieee.Attach
+	ieee := &IEEEBus{}
+
+	// Disk drives
+	drives := []*Drive{}
+	for address, filename := range map[Byte]string{8: *drive8, 9: *drive9} {
+		if filename == "" {
+			continue
+		}
+		disk, err := OpenDisk(filename, *seqASCII)
+		if err != nil {
+			fatal(err)
+		}
+		drive := NewDrive(disk)
+		err = ieee.Attach(address, drive)
+		if err != nil {
+			fatal(err)
+		}
+		drives = append(drives, drive)
+	}
+
+	// Cassette drive #1; the read line is connected below
+	datasette := &Datasette{
+		WAV: WAVTapeOptions{
+			Threshold: *wavThreshold,
+			Tolerance: *wavTolerance,
+			Invert:    *wavInvert,
+		},
+	}
+
 	// Create PIAs & VIA
-	var pia *PIA
 
 	// PIA1
 	pia1 := &PIA1{
 		Keyboard:  kbd,
-		KbdBuffer: buf,
+		IEEE:      ieee,
+		Datasette: datasette,
 	}
-	pia = &PIA{
+	pia1.PIA = &PIA{
 		Base:      0xe810,
 		PortRead:  pia1.PortRead,
 		PortWrite: pia1.PortWrite,
-		IRQ:       pia1.IRQ,
+		C2Write:   pia1.C2Write,
+	}
+	pia1.PIA.Reset()
+	bus.Map(pia1.PIA)
+
+	datasette.CA1 = pia1.PIA.CA1
+	if *tapFile != "" {
+		err := datasette.InsertTape(*tapFile)
+		if err != nil {
+			fatal(err)
+		}
+		switch *tapeButton {
+		case "":
+		case "play":
+			datasette.Control(TAPE_PLAY)
+		case "record":
+			datasette.Control(TAPE_RECORD)
+		default:
+			fatal(fmt.Errorf("invalid tape button %q", *tapeButton))
+		}
 	}
-	bus.Map(pia)
 
 	// PIA2
-	pia2 := &PIA2{}
-	pia = &PIA{
+	pia2 := &PIA2{
+		IEEE: ieee,
+	}
+	pia2.PIA = &PIA{
 		Base:      0xe820,
 		PortRead:  pia2.PortRead,
 		PortWrite: pia2.PortWrite,
-		IRQ:       pia2.IRQ,
+		C2Write:   pia2.C2Write,
 	}
-	bus.Map(pia)
+	pia2.PIA.Reset()
+	bus.Map(pia2.PIA)
 
 	// VIA
+	userPort := &UserPort{}
+	viaPorts := &VIAPorts{
+		IEEE:      ieee,
+		Datasette: datasette,
+		UserPort:  userPort,
+	}
 	via := &VIA{
-		Base: 0xe840,
+		Base:      0xe840,
+		PortRead:  viaPorts.PortRead,
+		PortWrite: viaPorts.PortWrite,
 	}
+	via.Reset()
 	bus.Map(via)
 
+	// User port device; the handshake lines are CA1 & CB2
+	userPort.VIA = via
+	if *userPortDevice != "" {
+		device, err := NewUserPortDevice(*userPortDevice, via.CA1)
+		if err != nil {
+			fatal(err)
+		}
+		userPort.Device = device
+	}
+	userPort.Reset()
+
+	// Joystick adapter, moved by the GUI or a script
+	joystick, _ := userPort.Device.(*UserPortJoystick)
+	var joyEvents *JoystickScript
+	if *joyScript != "" {
+		if joystick == nil {
+			fatal(fmt.Errorf("-joyscript requires -userport joystick"))
+		}
+		var err error
+		joyEvents, err = LoadJoystickScript(*joyScript)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	// Expansion RAM is mapped over everything else
+	if banked != nil {
+		bus.Map(banked)
+	}
+
+	// Printer; the character ROM is loaded below
+	var printer *Printer
+	if *printerBase != "" {
+		printer = &Printer{
+			Base: *printerBase,
+			PNG:  *printerPNG,
+		}
+		err := ieee.Attach(PRINTER_ADDRESS, printer)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
 	// Initialise video
 
 	/* The character ROM is special as it is not mapped to the main memory bus
 	like the other ROMS. Hence, it has a size but it's base "address" is 0x0000
 	and the video circuitry/routine generates an address directly into the ROM.
 	*/
-	charROM := &ROM{
-		Size: 0x800, // 2k
+	charROM, err := LoadModelCharset(roms, *charset, *columns)
+	if err != nil {
+		fatal(err)
+	}
+	if printer != nil {
+		printer.ROM = charROM
+	}
+
+	// Appearance of the display
+	crtPhosphor, err := ParsePhosphor(*phosphor)
+	if err != nil {
+		fatal(err)
+	}
+	for name, value := range map[string]float64{"scanlines": *scanlines, "persistence": *persistence, "bloom": *bloom} {
+		if value < 0 || value > 1 {
+			fatal(fmt.Errorf("-%s must be from 0 to 1", name))
+		}
+	}
+	if *printScreen != "" && *printScreen != "text" && *printScreen != "ansi" {
+		fatal(fmt.Errorf("-printscreen must be text or ansi"))
+	}
+
+	// The GUI & the recorder each draw frames with their own display
+	newDisplay := func() *Display {
+		return &Display{
+			CRT: &CRT{
+				Phosphor:    crtPhosphor,
+				Scanlines:   *scanlines,
+				Persistence: *persistence,
+				Bloom:       *bloom,
+			},
+		}
 	}
-	charROM.Reset()
-	charROM.Load("roms/char-901447-10.bin")
 
 	video := &Video{
 		Read:    bus.Read,
-		VIA_CB2: via.CB2,
-		PIA_CB1: pia1.CB1,
-		ROM:     charROM,
+		Charset: charROM,
+		VIA_CA2: via.CA2,
+		PIA_CB1: pia1.PIA.CB1,
+		CRTC:    crtc,
+		Wide:    *columns == 80,
+		Frames:  NewFrameBuffer(),
+	}
+
+	viaPorts.Video = video
+
+	var recorder *Recorder
+	if *recordFile != "" {
+		recorder, err = NewRecorder(*recordFile, newDisplay())
+		if err != nil {
+			fatal(err)
+		}
+		video.OnFrame = recorder.Frame
 	}
 
 	// Configure "cassette"
-	cas := &Cassette{}
+	cas := &Cassette{
+		Dir: *prgDir,
+	}
+
+	// Configure sound
+	sound := &Sound{
+		CB2: via.CB2,
+	}
+	if *soundOn {
+		audio, err := OpenSDLAudio()
+		if err != nil {
+			fatal(err)
+		}
+		defer audio.Close()
+		sound.Sinks = append(sound.Sinks, audio)
+	}
+	var wav *WAVWriter
+	if *wavFile != "" {
+		wav, err = CreateWAV(*wavFile, SAMPLE_RATE)
+		if err != nil {
+			fatal(err)
+		}
+		sound.Sinks = append(sound.Sinks, wav)
+	}
 
 	// Start GUI
 	gui := GUI{
-		Video: video,
+		Video:      video,
+		Display:    newDisplay(),
+		Joystick:   joystick != nil,
+		Scale:      *scale,
+		Fullscreen: *fullscreen,
 	}
-	err := gui.Init()
-	if err != nil {
-		panic(err)
+	for n, keys := range []string{*joyKeys1, *joyKeys2} {
+		if keys == "" {
+			continue
+		}
+		err := gui.SetJoyKeys(n, keys)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if !*headless {
+		err := gui.Init()
+		if err != nil {
+			panic(err)
+		}
+		defer gui.Stop()
+
+		// Without a window, LOAD"" loads the first file in an archive
+		cas.Choose = func(names []string) (int, error) {
+			return gui.ChooseDialog("Load program", names)
+		}
 	}
-	defer gui.Stop()
 
 	// Initialise the CPU & connect it to the bus
 	cpu := mos6502.NewCPU(bus.Read, bus.Write, nil, writer)
@@ -294,12 +642,75 @@ func main() {
 		pia1:     pia1,
 		pia2:     pia2,
 		via:      via,
+		ieee:     ieee,
 		cassette: cas,
-		gui:      &gui,
+	}
+	if !*headless {
+		pet.gui = &gui
 	}
 	pet.ReadWriter = &bus
 	cpu.Trap = pet.HandleTrap
 
+	// Write everything the PET has changed back to the host: the disks, the
+	// tape, print jobs, the sound & the video. This is done however the CPU
+	// stops, as exiting after an error skips any deferred functions.
+	writeBack := func() {
+		err := sound.Flush()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		if wav != nil {
+			err = wav.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			}
+		}
+
+		// Write back any changes to the disk images
+		for _, drive := range drives {
+			err = drive.Flush()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			}
+		}
+
+		// Write back anything recorded on the tape
+		err = datasette.Save()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+
+		// Finish any print job
+		if printer != nil {
+			err = printer.Flush()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			}
+		}
+		err = userPort.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+
+		// Finish the video & save the last frame
+		if recorder != nil {
+			err = recorder.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			}
+		}
+		if *screenshotFile != "" {
+			img, _ := newDisplay().Render(video.Frame())
+			err = SavePNG(*screenshotFile, img)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			}
+		}
+	}
+
+	// Stop after the given number of cycles, if set
+	maxCycles := uint64(runTime.Seconds() * CPU_CLOCK)
+
 	// Run the CPU & pheripherals
 	wg.Add(1)
 	go func() {
@@ -308,11 +719,30 @@ func main() {
 		running := true
 		for running {
 			// Execute a single instruction
+			cycles := cpu.Cycles()
 			err := cpu.Step()
 			if err != nil {
+				writeBack()
 				dumpAndExit(cpu, ram, fmt.Errorf("\nexecution stopped: %s", err))
 			}
 
+			// Advance the pheripherals by the same number of cycles
+			bus.Tick(int(cpu.Cycles() - cycles))
+			ieee.Tick(int(cpu.Cycles() - cycles))
+			datasette.Tick(int(cpu.Cycles() - cycles))
+			video.Tick(int(cpu.Cycles() - cycles))
+			userPort.Tick(int(cpu.Cycles() - cycles))
+			if joyEvents != nil {
+				joyEvents.Play(cpu.Cycles(), joystick)
+			}
+			if len(sound.Sinks) > 0 {
+				sound.Tick(int(cpu.Cycles() - cycles))
+			}
+
+			if maxCycles != 0 && cpu.Cycles() >= maxCycles {
+				running = false
+			}
+
 			// Handle any GUI events
 			select {
 			case event := <-events:
@@ -322,6 +752,24 @@ func main() {
 					break
 				case EventKeypress:
 					kbd.Scan(e.Key)
+				case EventTape:
+					datasette.Control(e.Control)
+				case EventJoystick:
+					if joystick != nil {
+						joystick.Set(e.Joystick, e.State)
+					}
+				case EventCharset:
+					// Keep the current character set if the image can't be loaded
+					rom, err := LoadModelCharset(roms, *charset, *columns)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "charset: %s\n", err)
+						break
+					}
+					video.Charset = rom
+					if printer != nil {
+						printer.ROM = rom
+					}
+					fmt.Fprintf(os.Stderr, "charset: reloaded\n")
 				}
 			default:
 			}
@@ -332,77 +780,65 @@ func main() {
 			}
 		}
 
+		writeBack()
+
 		// Cancel the context
 		cancel()
 	}()
 
 	// Start the GUI event loop
-	gui.EventLoop(ctx, events)
+	if *headless {
+		<-ctx.Done()
+	} else {
+		gui.EventLoop(ctx, events)
+	}
 
 	wg.Wait()
-	dump(cpu, ram)
-}
 
-// Trap handler
-func (p *PET) HandleTrap(selector Byte) {
-	switch selector {
-	case TRAP_LOAD:
-		filename, err := p.gui.LoadDialog("Load program", "PRG files", "prg")
-		if err == dialog.Cancelled {
-			break
-		}
-
-		err = p.cassette.Load(filename)
+	// The CPU has stopped, so the screen can be read
+	if *printScreen != "" {
+		err := WriteScreen(os.Stdout, video.Text(), *printScreen == "ansi")
 		if err != nil {
-			panic(err)
-		}
-		addr := p.cassette.Addr()
-		size := p.cassette.Size()
-		fmt.Printf("load %d bytes to address $%04x\n", size, addr)
-		for n := Word(0); n < size; n++ {
-			b := p.cassette.FetchByte()
-			p.bus.Write(addr+n, b)
-		}
-		// Set top of BASIC
-		p.WriteWord(VARTAB, addr+size+1)
-	case TRAP_SAVE:
-		// Get start & top of BASIC, calculate size
-		txttab := p.ReadWord(TXTTAB)
-		vartab := p.ReadWord(VARTAB)
-		size := vartab - txttab
-
-		fmt.Printf("txttab: $%04x, vartab: $%04x, size=%d\n", txttab, vartab, size)
-
-		// Copy BASIC data
-		data := make([]Byte, size)
-		for n := mos6502.Word(0); n < size; n++ {
-			data[n] = p.bus.Read(txttab + n)
+			fmt.Fprintf(os.Stderr, "%s\n", err)
 		}
+		return
+	}
+	dump(cpu, ram)
+}
 
-		filename, err := p.gui.LoadDialog("Save program", "PRG files", "prg")
-		if err == dialog.Cancelled {
-			break
+// t64Tool lists or extracts the files in T64 archives
+func t64Tool(list, extract string) error {
+	if list != "" {
+		t, err := OpenT64(list)
+		if err != nil {
+			return err
 		}
-
-		err = p.cassette.Save(filename, txttab, size, data)
+		t.List(os.Stdout)
+	}
+	if extract != "" {
+		t, err := OpenT64(extract)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		return t.Extract(".")
 	}
+	return nil
 }
 
-// Pheripheral Interface Adaptor #1
+// Pheripheral Interface Adaptor #1 port connections
 type PIA1 struct {
-	ports [4]Byte // 4 8bit ports
-	irq   bool    // Interrupt request
+	PIA *PIA // The PIA the ports are connected to
+
+	row Byte // Keyboard row select
 
 	Keyboard  *Keyboard  // Keyboard
-	KbdBuffer chan (Key) // Keyboard "buffer"
+	IEEE      *IEEEBus   // IEEE-488 bus
+	Datasette *Datasette // Cassette #1
 }
 
 func (p *PIA1) PortRead(port int) Byte {
 	switch port {
-	case 0:
+	case PIA_PORTA:
 		/* DICcKKKK
 		D=Diagnostic sense
 		I=IEEE EOI in
@@ -410,59 +846,125 @@ func (p *PIA1) PortRead(port int) Byte {
 		c=Cassette sense #1
 		K=Keyboard Row select
 		*/
-		return p.ports[port] | mos6502.BIT_7 // Diagnostic Sense is always high
-	case 2:
+		// Diagnostic Sense is always high
+		data := Byte(0xff)
+		if p.IEEE.EOI() {
+			data &^= 0x40
+		}
+		if p.Datasette.Sense() {
+			data &^= 0x10
+		}
+		return data
+	case PIA_PORTB:
 		// KKKKKKKK	K=Keyboard Row Input
+		return p.Keyboard.Get(p.row)
+	}
+	return 0xff
+}
 
+func (p *PIA1) PortWrite(port int, data Byte) {
+	if port == PIA_PORTA {
 		// get keyboard scan row (bits 0-3)
-		row := p.ports[0] & 0x0f
-		return p.Keyboard.Get(row)
+		p.row = data & 0x0f
 	}
-	return p.ports[port]
 }
 
-func (p *PIA1) PortWrite(port int, data Byte) {
-	p.ports[port] = data
+func (p *PIA1) C2Write(port int, level bool) {
+	switch port {
+	case PIA_PORTA:
+		// CA2 = IEEE EOI out
+		p.IEEE.SetEOI(!level)
+	case PIA_PORTB:
+		// CB2 = Cassette #1 motor, on when low
+		p.Datasette.SetMotor(!level)
+	}
 }
 
-func (p *PIA1) IRQ() bool {
-	// Get & clear the current IRQ status
-	i := p.irq
-	p.irq = false
+// Pheripheral Interface Adaptor #2 port connections
+type PIA2 struct {
+	PIA *PIA // The PIA the ports are connected to
+
+	IEEE *IEEEBus // IEEE-488 bus
+}
 
-	select {
-	case <-p.KbdBuffer:
-		// Handle keypresses immediately
-		return true
-	default:
-		return i
+func (p *PIA2) PortRead(port int) Byte {
+	if port == PIA_PORTA {
+		// IEEE data in. The data lines are active low
+		return ^p.IEEE.Data()
 	}
+	return 0xff
 }
 
-func (p *PIA1) CB1(retrace bool) {
-	// Set Retrace Interrupt flag
-	if retrace {
-		p.ports[3] |= 0x80
-		p.irq = true
-	} else {
-		p.ports[3] ^= 0x80
-		p.irq = false
+func (p *PIA2) PortWrite(port int, data Byte) {
+	if port == PIA_PORTB {
+		// IEEE data out
+		p.IEEE.SetData(^data)
 	}
 }
 
-// Pheripheral Interface Adaptor #2
-type PIA2 struct {
-	ports [4]Byte // 4 8bit ports
+func (p *PIA2) C2Write(port int, level bool) {
+	switch port {
+	case PIA_PORTA:
+		// CA2 = IEEE NDAC out
+		p.IEEE.SetNDAC(!level)
+	case PIA_PORTB:
+		// CB2 = IEEE DAV out
+		p.IEEE.SetDAV(!level)
+	}
 }
 
-func (p *PIA2) PortRead(port int) Byte {
-	return p.ports[port]
+// Versatile Interface Adaptor port connections
+type VIAPorts struct {
+	IEEE      *IEEEBus   // IEEE-488 bus
+	Datasette *Datasette // Cassette #1
+	UserPort  *UserPort  // User port
+	Video     *Video     // Vertical drive
 }
 
-func (p *PIA2) PortWrite(port int, data Byte) {
-	p.ports[port] = data
+func (p *VIAPorts) PortRead(port int) Byte {
+	switch port {
+	case VIA_PORTB:
+		/* DNVSRAWN
+		D=IEEE DAV in
+		N=IEEE NRFD in
+		V=Video sync in (vertical drive)
+		S=Cassette #2 motor
+		R=Cassette write
+		A=IEEE ATN out
+		W=IEEE NRFD out
+		N=IEEE NDAC in
+		*/
+		data := Byte(0xff)
+		if p.Video.Retrace() {
+			data &^= 0x20
+		}
+		if p.IEEE.DAV() {
+			data &^= 0x80
+		}
+		if p.IEEE.NRFD() {
+			data &^= 0x40
+		}
+		if p.IEEE.NDAC() {
+			data &^= 0x01
+		}
+		return data
+	case VIA_PORTA:
+		// User port data lines
+		return p.UserPort.Read()
+	}
+	return 0xff
 }
 
-func (p *PIA2) IRQ() bool {
-	return false
+func (p *VIAPorts) PortWrite(port int, data Byte) {
+	if port == VIA_PORTA {
+		p.UserPort.Write(data)
+	}
+	if port == VIA_PORTB {
+		// IEEE ATN & NRFD out
+		p.IEEE.SetATN(data&0x04 == 0)
+		p.IEEE.SetNRFD(data&0x02 == 0)
+
+		// Cassette write
+		p.Datasette.SetWrite(data&0x08 != 0)
+	}
 }
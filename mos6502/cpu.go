@@ -21,6 +21,7 @@ type CPU struct {
 
 	instructionSet map[Opcode]Instruction // Table of opcodes
 	insCount       int                    // Number of instructions executed
+	cycles         uint64                 // Number of clock cycles executed
 	isr            bool                   // Is the CPU running the ISR?
 
 	BusRead  ReadByteFunc  // Read a single byte from the bus
@@ -89,8 +90,14 @@ func (c *CPU) Reset() {
 	// Initialise opcode table
 	c.instructionSet = c.makeInstructionSet()
 
-	// Reset the instruction count
+	// Reset the instruction & cycle counts
 	c.insCount = 0
+	c.cycles = 0
+}
+
+// Cycles returns the number of clock cycles executed since the last Reset
+func (c *CPU) Cycles() uint64 {
+	return c.cycles
 }
 
 // Step fetches & executes a single instruction
@@ -113,6 +120,7 @@ func (c *CPU) Step() error {
 		return fmt.Errorf("invalid or unknown instruction 0x%2x", opcode)
 	}
 	c.insCount++
+	c.cycles += uint64(opcodeCycles[opcode])
 
 	// Disasemble & log
 	switch ins.Bytes {
@@ -137,6 +145,7 @@ func (c *CPU) Step() error {
 func (c *CPU) Interrupt() {
 	if c.Registers.P.I == false && c.isr == false {
 		c.isr = true
+		c.cycles += INTERRUPT_CYCLES
 
 		c.PushWord(c.PC.Get() - 1)
 		c.PushByte(c.Registers.P.GetByte())
@@ -0,0 +1,27 @@
+package mos6502
+
+// Number of clock cycles taken by each opcode. These are the base timings;
+// the additional cycles for crossing a page boundary or taking a branch are
+// not counted.
+var opcodeCycles = [256]uint8{
+	//       0  1  2  3  4  5  6  7  8  9  a  b  c  d  e  f
+	/* 00 */ 7, 6, 0, 0, 0, 3, 5, 0, 3, 2, 2, 0, 0, 4, 6, 0,
+	/* 10 */ 2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0,
+	/* 20 */ 6, 6, 0, 0, 3, 3, 5, 0, 4, 2, 2, 0, 4, 4, 6, 0,
+	/* 30 */ 2, 5, 0, 0, 4, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0,
+	/* 40 */ 6, 6, 0, 0, 0, 3, 5, 0, 3, 2, 2, 0, 3, 4, 6, 0,
+	/* 50 */ 2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0,
+	/* 60 */ 6, 6, 0, 0, 0, 3, 5, 0, 4, 2, 2, 0, 5, 4, 6, 0,
+	/* 70 */ 2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0,
+	/* 80 */ 0, 6, 0, 0, 3, 3, 3, 0, 2, 0, 2, 0, 4, 4, 4, 0,
+	/* 90 */ 2, 6, 0, 0, 4, 4, 4, 0, 2, 5, 2, 0, 0, 5, 0, 0,
+	/* a0 */ 2, 6, 2, 0, 3, 3, 3, 0, 2, 2, 2, 0, 4, 4, 4, 0,
+	/* b0 */ 2, 5, 0, 0, 4, 4, 4, 0, 2, 4, 2, 0, 4, 4, 4, 0,
+	/* c0 */ 2, 6, 0, 0, 3, 3, 5, 0, 2, 2, 2, 0, 4, 4, 6, 0,
+	/* d0 */ 2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0,
+	/* e0 */ 2, 6, 0, 0, 3, 3, 5, 0, 2, 2, 2, 0, 4, 4, 6, 0,
+	/* f0 */ 2, 5, 2, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0,
+}
+
+// Number of clock cycles taken to enter the interrupt handler
+const INTERRUPT_CYCLES = 7
@@ -200,10 +200,16 @@ func (c *CPU) op_bvs(i Instruction) error {
 	return nil
 }
 
+// Force Break
 func (c *CPU) op_brk(i Instruction) error {
-	c.PushWord(c.PC.Get() + 2)
-	c.PushByte(c.Registers.P.GetByte())
-	c.Registers.P.B = true
+	// BRK skips the byte which follows it. PC is already past the opcode, &
+	// RTI adds one to the address it pulls.
+	c.PushWord(c.PC.Get())
+
+	// The pushed status has the break flag set, so that the interrupt handler
+	// can tell BRK from IRQ
+	c.PushByte(c.Registers.P.GetByte() | BIT_4 | BIT_5)
+	c.Registers.P.I = true
 
 	addr := c.ReadWord(VEC_INTERRUPT)
 	c.PC.Set(addr)
@@ -0,0 +1,34 @@
+package mos6502
+
+import (
+	"testing"
+)
+
+func Test_cycles(t *testing.T) {
+	m := newMem()
+	c := newCPU(m)
+
+	// LDA #$01; STA $0300; JMP $0200
+	m.WriteByte(INS_LDA_IM)
+	m.WriteByte(0x01)
+	m.WriteByte(INS_STA_AB)
+	m.WriteWord(dataStart)
+	m.WriteByte(INS_JMP_AB)
+	m.WriteWord(exeStart)
+
+	expected := []uint64{2, 6, 9, 11}
+	for n, e := range expected {
+		err := c.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Cycles() != e {
+			t.Errorf("step %d: expected %d cycles, got %d", n, e, c.Cycles())
+		}
+	}
+
+	c.Reset()
+	if c.Cycles() != 0 {
+		t.Errorf("cycles not reset: got %d", c.Cycles())
+	}
+}
@@ -11,12 +11,12 @@ const (
 
 // "fake" memory that provides a bunch of helper methods
 type fakeMem struct {
-	mem     [memMax]Byte
+	mem     [int(memMax) + 1]Byte
 	curAddr Word
 }
 
 func (m *fakeMem) Reset() {
-	for n := Word(0); n < memMax; n++ {
+	for n := range m.mem {
 		m.mem[n] = 0x00
 	}
 	// Start of executable code is above the stack
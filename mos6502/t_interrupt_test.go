@@ -0,0 +1,42 @@
+package mos6502
+
+import (
+	"testing"
+)
+
+func Test_interrupt(t *testing.T) {
+	//
+	//	INS_BRK
+	//
+	testCases{
+		testCase{
+			INS_BRK,
+			"BRK",
+			// Setup
+			func(t *testing.T, c *CPU, m *fakeMem) {
+				m.SetWord(VEC_INTERRUPT, 0x1234)
+				c.Registers.P.I = false
+				c.Registers.P.C = true
+			},
+			// Check
+			func(t *testing.T, c *CPU, m *fakeMem) {
+				// Check the return address skips the byte after BRK, allowing
+				// for RTI adding one
+				if c.ReadWord(STACK_TOP-2) != exeStart {
+					t.Errorf("return address: got $%04x, expected $%04x", c.ReadWord(STACK_TOP-2), exeStart)
+				}
+				// Check the pushed status has the break flag & bit 5 set
+				CompareMem(t, m, STACK_TOP-3, BIT_0|BIT_4|BIT_5)
+				// Check the stack pointer has decremented by three
+				CompareSP(t, c, 0xfc)
+
+				if c.Registers.P.I != true {
+					t.Error("interrupt flag is not set")
+				}
+				if c.PC.Get() != 0x1234 {
+					t.Errorf("PC: got $%04x, expected $1234", c.PC.Get())
+				}
+			},
+		},
+	}.Run(t)
+}
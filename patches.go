@@ -2,100 +2,95 @@ package main
 
 import "github.com/vanders/pet/mos6502"
 
+/*
+The LOAD & SAVE patches replace the start of the kernal routines. Each reads
+the filename, device & secondary address from the BASIC text with the kernal's
+own routine & then traps to the emulator. The trap returns 0 in A, or the
+offset of a kernal error message, which is printed by the kernal's error
+routine.
+
+VERIFY sets the verify flag & calls the LOAD routine just after the point where
+the flag is cleared, so the call to read the parameters must stay at the same
+offset. Likewise the monitor's .S command sets the start & end addresses itself
+& calls the SAVE routine just after they're set from the BASIC program, so the
+trap must stay at the same offset.
+*/
 var (
 	LOADPATCH_v2 = []Byte{
-		mos6502.INS_PHP,    // PHP: Store current flags
-		mos6502.INS_PHA,    // PHA: Store current A register contents
+		mos6502.INS_LDA_IM, // LDA: Load A register...
+		0x00,               // #$00: LOAD, not VERIFY
+		mos6502.INS_STA_ZP, // STA: Store A register...
+		VERCK,              // in the verify flag
+		mos6502.INS_JSR_AB, // read the filename & device from the BASIC text
+		0x3e,               // VERIFY enters here
+		0xf4,
 		mos6502.INS_LDA_IM, // LDA: Load A register...
 		TRAP_LOAD,          // #$01: with trap selector for LOAD
 		mos6502.INS_TRAP,   // TRAP: Emulator trap
-		mos6502.INS_PLA,    // PLA: Restore contents of A register
-		mos6502.INS_PLP,    // PLP: Restore flags
-		mos6502.INS_RTS,    // RTS: Return from vector subroutine
+		mos6502.INS_TAY,    // TAY: Transfer the message offset to Y
+		mos6502.INS_BEQ_RE, // BEQ: Return if there was no error
+		0x03,
+		mos6502.INS_JMP_AB, // print error message
+		0x70,
+		0xf5,
+		mos6502.INS_RTS, // RTS: Return from vector subroutine
 	}
 
 	LOADPATCH_v4 = []Byte{
-		mos6502.INS_PHP, // PHP: Store current flags
-		mos6502.INS_PHA, // PHA: Store current A register contents
-		mos6502.INS_TYA, // TYA: Transfer Y to A
-		mos6502.INS_PHA, // PHY: Store current A (Y) register contents
-		mos6502.INS_LDY_IM,
-		0x41,               // press play
-		mos6502.INS_JSR_AB, // print message
-		0x85,
-		0xf1,
-		mos6502.INS_LDY_IM,
-		0x56,               // on tape #
-		mos6502.INS_JSR_AB, // print message
-		0x85,
-		0xf1,
-		mos6502.INS_LDA_ZP,
-		0xd4, // current tape #
-		mos6502.INS_ORA_IM,
-		0x30,
-		mos6502.INS_JSR_AB, // print character
-		0x02,
-		0xe2,
+		mos6502.INS_LDA_IM, // LDA: Load A register...
+		0x00,               // #$00: LOAD, not VERIFY
+		mos6502.INS_STA_ZP, // STA: Store A register...
+		VERCK,              // in the verify flag
+		mos6502.INS_JSR_AB, // read the filename & device from the BASIC text
+		0x7d,               // VERIFY enters here
+		0xf4,
 		mos6502.INS_LDA_IM, // LDA: Load A register...
 		TRAP_LOAD,          // #$01: with trap selector for LOAD
 		mos6502.INS_TRAP,   // TRAP: Emulator trap
-		mos6502.INS_PLA,    // PLA: Restore contents of A (Y) register
-		mos6502.INS_TAY,    // TAY: Transfer A to Y
-		mos6502.INS_PLA,    // PLA: Restore contents of A register
-		mos6502.INS_PLP,    // PLP: Restore flags
-		mos6502.INS_RTS,    // RTS: Return from vector subroutine
+		mos6502.INS_TAY,    // TAY: Transfer the message offset to Y
+		mos6502.INS_BEQ_RE, // BEQ: Return if there was no error
+		0x03,
+		mos6502.INS_JMP_AB, // print error message
+		0xaf,
+		0xf5,
+		mos6502.INS_RTS, // RTS: Return from vector subroutine
 	}
 
 	SAVEPATCH_v2 = []Byte{
-		mos6502.INS_PHP,    // PHP: Store current flags
-		mos6502.INS_PHA,    // PHA: Store current A register contents
-		mos6502.INS_LDA_IM, // LDA: Load A register...
+		mos6502.INS_JSR_AB, // read the filename & device from the BASIC text
+		0x3e,
+		0xf4,
+		mos6502.INS_JSR_AB, // set the start & end addresses to the BASIC program
+		0x8d,
+		0xf6,
+		mos6502.INS_LDA_IM, // LDA: Load A register... (the monitor enters here)
 		TRAP_SAVE,          // #$02: with trap selector for SAVE
 		mos6502.INS_TRAP,   // TRAP: Emulator trap
-		mos6502.INS_PLA,    // PLA: Restore contents of A register
-		mos6502.INS_PLP,    // PLP: Restore flags
-		mos6502.INS_RTS,    // RTS: Return from vector subroutine
+		mos6502.INS_TAY,    // TAY: Transfer the message offset to Y
+		mos6502.INS_BEQ_RE, // BEQ: Return if there was no error
+		0x03,
+		mos6502.INS_JMP_AB, // print error message
+		0x70,
+		0xf5,
+		mos6502.INS_RTS, // RTS: Return from vector subroutine
 	}
 
 	SAVEPATCH_v4 = []Byte{
-		mos6502.INS_PHP, // PHP: Store current flags
-		mos6502.INS_PHA, // PHA: Store current A register contents
-		mos6502.INS_TYA, // TYA: Transfer Y to A
-		mos6502.INS_PHA, // PHY: Store current A (Y) register contents
-		mos6502.INS_LDY_IM,
-		0x41,               // press play
-		mos6502.INS_JSR_AB, // print message
-		0x85,
-		0xf1,
-		mos6502.INS_LDY_IM,
-		0x4d,               // & record
-		mos6502.INS_JSR_AB, // print message
-		0x85,
-		0xf1,
-		mos6502.INS_LDY_IM,
-		0x56,               // on tape #
-		mos6502.INS_JSR_AB, // print message
-		0x85,
-		0xf1,
-		mos6502.INS_LDA_ZP,
-		0xd4, // current tape #
-		mos6502.INS_ORA_IM,
-		0x30,
-		mos6502.INS_JSR_AB, // print character
-		0x02,
-		0xe2,
-		mos6502.INS_LDY_IM,
-		0x64,               // writing
-		mos6502.INS_JSR_AB, // print message
-		0x85,
-		0xf1,
-		mos6502.INS_LDA_IM, // LDA: Load A register...
+		mos6502.INS_JSR_AB, // read the filename & device from the BASIC text
+		0x7d,
+		0xf4,
+		mos6502.INS_JSR_AB, // set the start & end addresses to the BASIC program
+		0xcc,
+		0xf6,
+		mos6502.INS_LDA_IM, // LDA: Load A register... (the monitor enters here)
 		TRAP_SAVE,          // #$02: with trap selector for SAVE
 		mos6502.INS_TRAP,   // TRAP: Emulator trap
-		mos6502.INS_PLA,    // PLA: Restore contents of A (Y) register
-		mos6502.INS_TAY,    // TAY: Transfer A to Y
-		mos6502.INS_PLA,    // PLA: Restore contents of A register
-		mos6502.INS_PLP,    // PLP: Restore flags
-		mos6502.INS_RTS,    // RTS: Return from vector subroutine
+		mos6502.INS_TAY,    // TAY: Transfer the message offset to Y
+		mos6502.INS_BEQ_RE, // BEQ: Return if there was no error
+		0x03,
+		mos6502.INS_JMP_AB, // print error message
+		0xaf,
+		0xf5,
+		mos6502.INS_RTS, // RTS: Return from vector subroutine
 	}
 )
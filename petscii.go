@@ -0,0 +1,125 @@
+package main
+
+/*
+PETSCII & ASCII share the digits & most punctuation, but the letters are
+swapped: unshifted PETSCII letters ($41-$5A) are shown in upper case on a PET,
+& shifted letters ($C1-$DA) in lower case, or as graphics. The conversions
+here map unshifted letters to lower case ASCII, which suits filenames & text
+typed on a PET in upper case, & CR to LF.
+*/
+
+// petsciiToASCII converts a PETSCII character to ASCII
+func petsciiToASCII(c byte) byte {
+	switch {
+	case c >= 'A' && c <= 'Z':
+		return c + ('a' - 'A')
+	case c >= 0xc1 && c <= 0xda:
+		return c - 0xc1 + 'A'
+	case c == '\r':
+		return '\n'
+	}
+	return c
+}
+
+// asciiToPETSCII converts an ASCII character to PETSCII
+func asciiToPETSCII(c byte) byte {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return c - ('a' - 'A')
+	case c >= 'A' && c <= 'Z':
+		return c - 'A' + 0xc1
+	case c == '\n':
+		return '\r'
+	}
+	return c
+}
+
+// Unicode for the PETSCII graphics characters $A0-$BF
+var petsciiGraphicsA0 = [32]rune{
+	' ', '▌', '▄', '▔', '▁', '▏', '▒', '▕',
+	'\U0001fb8f', '◤', '\U0001fb87', '├', '▗', '└', '┐', '▂',
+	'┌', '┴', '┬', '┤', '▎', '▍', '\U0001fb88', '\U0001fb82',
+	'\U0001fb83', '▃', '\U0001fb7f', '▖', '▝', '┘', '▘', '▚',
+}
+
+// Unicode for the PETSCII graphics characters $C0-$DF
+var petsciiGraphicsC0 = [32]rune{
+	'─', '♠', '\U0001fb72', '\U0001fb78', '\U0001fb77', '\U0001fb76', '\U0001fb7a', '\U0001fb71',
+	'\U0001fb74', '╮', '╰', '╯', '\U0001fb7c', '╲', '╱', '\U0001fb7d',
+	'\U0001fb7e', '●', '\U0001fb7b', '♥', '\U0001fb70', '╭', '╳', '○',
+	'♣', '\U0001fb75', '♦', '┼', '\U0001fb8c', '│', 'π', '◥',
+}
+
+/*
+petsciiToRune converts a printable PETSCII character to Unicode. text selects
+the lower case character set, rather than upper case & graphics. ok is false
+for control characters.
+*/
+func petsciiToRune(c byte, text bool) (rune, bool) {
+	switch {
+	case c < 0x20 || (c >= 0x80 && c < 0xa0):
+		return 0, false
+	case c == 0x5c:
+		return '£', true
+	case c == 0x5e:
+		return '↑', true
+	case c == 0x5f:
+		return '←', true
+	case c >= 0x41 && c <= 0x5a && text:
+		return rune(c) + ('a' - 'A'), true
+	case c < 0x60:
+		return rune(c), true
+	case c < 0x80:
+		// Duplicates of $C0-$DF
+		c += 0x60
+	case c == 0xff:
+		c = 0xde
+	case c >= 0xe0:
+		// Duplicates of $A0-$BE
+		c -= 0x40
+	}
+
+	if c >= 0xc1 && c <= 0xda && text {
+		return rune(c-0xc1) + 'A', true
+	}
+	if c >= 0xc0 {
+		return petsciiGraphicsC0[c-0xc0], true
+	}
+	return petsciiGraphicsA0[c-0xa0], true
+}
+
+// petsciiToScreen converts a printable PETSCII character to a screen code,
+// which is the index of the character in the character ROM
+func petsciiToScreen(c byte) (byte, bool) {
+	switch {
+	case c < 0x20 || (c >= 0x80 && c < 0xa0):
+		return 0, false
+	case c < 0x40:
+		return c, true
+	case c < 0x60:
+		return c - 0x40, true
+	case c < 0x80:
+		return c - 0x20, true
+	case c < 0xc0:
+		return c - 0x40, true
+	case c < 0xe0:
+		return c - 0x80, true
+	case c == 0xff:
+		return 0x5e, true
+	}
+	return c - 0x80, true
+}
+
+// screenToPETSCII converts a screen code, without the reverse video bit, to
+// the PETSCII character which prints it
+func screenToPETSCII(c byte) byte {
+	switch {
+	case c < 0x20:
+		return c + 0x40
+	case c < 0x40:
+		return c
+	case c < 0x60:
+		return c + 0x80
+	}
+	return c + 0x40
+}
@@ -1,12 +1,39 @@
 package main
 
-// PIA models a Pheripheral Interface Adaptor
+// PIA port numbers, for PortRead, PortWrite & C2Write
+const (
+	PIA_PORTA = 0
+	PIA_PORTB = 1
+)
+
+// PIA control register bits
+const (
+	PIA_CR_C1_IRQ  = 0x01 // C1 interrupt enable
+	PIA_CR_C1_EDGE = 0x02 // C1 active edge (0 = negative, 1 = positive)
+	PIA_CR_PR      = 0x04 // Select the peripheral (1) or data direction (0) register
+	PIA_CR_C2_IRQ  = 0x08 // C2 input: interrupt enable. C2 output: mode select
+	PIA_CR_C2_EDGE = 0x10 // C2 input: active edge. C2 output: manual output
+	PIA_CR_C2_OUT  = 0x20 // C2 is an output
+	PIA_CR_IRQ2    = 0x40 // C2 interrupt flag (read only)
+	PIA_CR_IRQ1    = 0x80 // C1 interrupt flag (read only)
+)
+
+// PIA models a MOS 6520 Pheripheral Interface Adaptor
 type PIA struct {
 	Base Word // Base address
 
-	PortRead  func(p int) Byte
-	PortWrite func(p int, data Byte)
-	IRQ       func() bool
+	PortRead  func(port int) Byte        // Read the input pins of a port
+	PortWrite func(port int, data Byte)  // Notify a change to the output pins of a port
+	C2Write   func(port int, level bool) // Notify a change to the CA2 or CB2 output
+
+	out [2]Byte // Output registers
+	ddr [2]Byte // Data direction registers
+	cr  [2]Byte // Control registers
+
+	c1     [2]bool // CA1 & CB1 input states
+	c2     [2]bool // CA2 & CB2 input states
+	c2Out  [2]bool // CA2 & CB2 output states
+	c2Puls [2]bool // CA2 or CB2 pulse output is active
 }
 
 func (p *PIA) GetBase() Word {
@@ -17,21 +44,187 @@ func (p *PIA) GetSize() Word {
 	return Word(4)
 }
 
+// irq returns true if either interrupt output of a port is active
+func (p *PIA) irq(port int) bool {
+	cr := p.cr[port]
+	if cr&PIA_CR_IRQ1 != 0 && cr&PIA_CR_C1_IRQ != 0 {
+		return true
+	}
+	return cr&PIA_CR_IRQ2 != 0 && cr&PIA_CR_C2_IRQ != 0 && cr&PIA_CR_C2_OUT == 0
+}
+
 func (p *PIA) CheckInterrupt() bool {
-	return p.IRQ()
+	return p.irq(PIA_PORTA) || p.irq(PIA_PORTB)
+}
+
+// Reset the PIA as though RES had been asserted
+func (p *PIA) Reset() {
+	for port := range p.cr {
+		p.out[port] = 0x00
+		p.ddr[port] = 0x00
+		p.cr[port] = 0x00
+		p.c1[port] = true
+		p.c2[port] = true
+		p.c2Out[port] = true
+		p.c2Puls[port] = false
+	}
+}
+
+// readPins returns the state of the input pins of a port. Unconnected pins
+// are pulled high.
+func (p *PIA) readPins(port int) Byte {
+	if p.PortRead == nil {
+		return 0xff
+	}
+	return p.PortRead(port)
+}
+
+// writePins notifies the new state of the output pins of a port. Pins which
+// are configured as inputs are pulled high.
+func (p *PIA) writePins(port int) {
+	if p.PortWrite != nil {
+		p.PortWrite(port, p.out[port]|^p.ddr[port])
+	}
+}
+
+// setC2 changes the state of the CA2 or CB2 output
+func (p *PIA) setC2(port int, level bool) {
+	if p.c2Out[port] == level {
+		return
+	}
+	p.c2Out[port] = level
+	if p.C2Write != nil {
+		p.C2Write(port, level)
+	}
 }
 
 func (p *PIA) Read(address Word) Byte {
-	port := int(address - p.Base)
-	if port >= 0 && port <= 3 {
-		return p.PortRead(port)
+	reg := int(address - p.Base)
+	port := reg >> 1
+
+	switch reg {
+	case 0, 2: // Peripheral or data direction register
+		if p.cr[port]&PIA_CR_PR == 0 {
+			return p.ddr[port]
+		}
+		data := (p.readPins(port) &^ p.ddr[port]) | (p.out[port] & p.ddr[port])
+
+		// Reading the port clears the interrupt flags
+		p.cr[port] &^= PIA_CR_IRQ1 | PIA_CR_IRQ2
+
+		// CA2 read strobe
+		if port == PIA_PORTA && p.cr[port]&(PIA_CR_C2_OUT|PIA_CR_C2_EDGE) == PIA_CR_C2_OUT {
+			p.strobeC2(port)
+		}
+		return data
+	case 1, 3: // Control register
+		return p.cr[port]
 	}
 	return Byte(0)
 }
 
 func (p *PIA) Write(address Word, data Byte) {
-	port := int(address - p.Base)
-	if port >= 0 && port <= 3 {
-		p.PortWrite(port, data)
+	reg := int(address - p.Base)
+	port := reg >> 1
+
+	switch reg {
+	case 0, 2: // Peripheral or data direction register
+		if p.cr[port]&PIA_CR_PR == 0 {
+			p.ddr[port] = data
+		} else {
+			p.out[port] = data
+
+			// CB2 write strobe
+			if port == PIA_PORTB && p.cr[port]&(PIA_CR_C2_OUT|PIA_CR_C2_EDGE) == PIA_CR_C2_OUT {
+				p.strobeC2(port)
+			}
+		}
+		p.writePins(port)
+	case 1, 3: // Control register
+		// The interrupt flags are read only
+		p.cr[port] = (p.cr[port] & (PIA_CR_IRQ1 | PIA_CR_IRQ2)) | (data &^ (PIA_CR_IRQ1 | PIA_CR_IRQ2))
+
+		switch data & (PIA_CR_C2_OUT | PIA_CR_C2_EDGE) {
+		case PIA_CR_C2_OUT | PIA_CR_C2_EDGE:
+			// Manual output
+			p.setC2(port, data&PIA_CR_C2_IRQ != 0)
+		default:
+			// Handshake or pulse outputs idle high, & inputs are pulled high
+			p.setC2(port, true)
+		}
 	}
 }
+
+// strobeC2 takes CA2 or CB2 low for a handshake or pulse output
+func (p *PIA) strobeC2(port int) {
+	p.setC2(port, false)
+	if p.cr[port]&PIA_CR_C2_IRQ != 0 {
+		// Pulse output, restored on the next clock cycle
+		p.c2Puls[port] = true
+	}
+}
+
+// Tick restores any pulse outputs
+func (p *PIA) Tick(cycles int) {
+	for port := range p.c2Puls {
+		if p.c2Puls[port] {
+			p.c2Puls[port] = false
+			p.setC2(port, true)
+		}
+	}
+}
+
+// setC1 sets the state of the CA1 or CB1 input line
+func (p *PIA) setC1(port int, level bool) {
+	cr := p.cr[port]
+	if activeEdge(p.c1[port], level, cr&PIA_CR_C1_EDGE != 0) {
+		p.cr[port] |= PIA_CR_IRQ1
+
+		// The active edge ends a handshake
+		if cr&(PIA_CR_C2_OUT|PIA_CR_C2_EDGE|PIA_CR_C2_IRQ) == PIA_CR_C2_OUT {
+			p.setC2(port, true)
+		}
+	}
+	p.c1[port] = level
+}
+
+// setC2In sets the state of the CA2 or CB2 line, when it is an input
+func (p *PIA) setC2In(port int, level bool) {
+	cr := p.cr[port]
+	if cr&PIA_CR_C2_OUT == 0 && activeEdge(p.c2[port], level, cr&PIA_CR_C2_EDGE != 0) {
+		p.cr[port] |= PIA_CR_IRQ2
+	}
+	p.c2[port] = level
+}
+
+// CA1 sets the state of the CA1 input line
+func (p *PIA) CA1(level bool) {
+	p.setC1(PIA_PORTA, level)
+}
+
+// CB1 sets the state of the CB1 input line
+func (p *PIA) CB1(level bool) {
+	p.setC1(PIA_PORTB, level)
+}
+
+// CA2In sets the state of the CA2 line, when it is an input
+func (p *PIA) CA2In(level bool) {
+	p.setC2In(PIA_PORTA, level)
+}
+
+// CB2In sets the state of the CB2 line, when it is an input
+func (p *PIA) CB2In(level bool) {
+	p.setC2In(PIA_PORTB, level)
+}
+
+// Additional helper functions for exposing specific lines
+
+// Return the current state of the CA2 output line
+func (p *PIA) CA2() bool {
+	return p.c2Out[PIA_PORTA]
+}
+
+// Return the current state of the CB2 output line
+func (p *PIA) CB2() bool {
+	return p.c2Out[PIA_PORTB]
+}
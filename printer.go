@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+)
+
+// Printer page layout
+const (
+	PRINTER_COLUMNS = 80
+	PRINTER_LINES   = 66
+	PRINTER_ADDRESS = 4
+)
+
+// Printer control characters
+const (
+	PRINTER_LF      = 0x0a
+	PRINTER_FF      = 0x0c
+	PRINTER_CR      = 0x0d
+	PRINTER_LOWER   = 0x11 // Cursor down: lower case character set
+	PRINTER_RVS_ON  = 0x12
+	PRINTER_UPPER   = 0x91 // Cursor up: upper case & graphics character set
+	PRINTER_RVS_OFF = 0x92
+)
+
+// Secondary address which selects the lower case character set
+const PRINTER_SA_LOWER = 7
+
+// A job ends if the printer is idle for this many cycles
+const PRINTER_IDLE = 5 * CPU_CLOCK
+
+// printerCell is a character printed on a page
+type printerCell struct {
+	c       byte // PETSCII character
+	lower   bool // Lower case character set
+	reverse bool // Reverse field
+}
+
+type printerPage [][]printerCell
+
+/*
+Printer emulates a Commodore 4022 printer on the IEEE-488 bus. Each print job
+is written to a text file, with PETSCII translated to UTF-8, & optionally to a
+PNG image of each page drawn with the character ROM, which shows graphics &
+reverse characters as the PET displays them.
+
+A job starts when the printer receives data & ends when the PET closes the
+printer file, when nothing has been printed for PRINTER_IDLE cycles, or when
+the emulator exits. The PET only tells the printer that the file is closed if
+it was opened with a secondary address E.g. OPEN4,4,0. Each job is written to
+a new file, E.g. printer-001.txt, printer-002.txt & so on.
+*/
+type Printer struct {
+	Base string // Output filename, without the number & extension
+	PNG  bool   // Also write an image of each page
+	ROM  *ROM   // Character ROM, for PNG output
+
+	job    int           // Last job number
+	pages  []printerPage // Pages of the current job, or nil if no job
+	line   []printerCell // Current line
+	lower  bool          // Lower case character set
+	rvs    bool          // Reverse field
+	lastCR bool          // The last character was a carriage return
+	idle   int           // Cycles since the last character
+
+	listening bool
+}
+
+func (p *Printer) Listen(secondary Byte) {
+	switch secondary & 0xf0 {
+	case IEEE_CLOSE:
+		err := p.endJob()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "printer: %s\n", err)
+		}
+	case IEEE_OPEN, IEEE_DATA:
+		p.listening = true
+		p.lower = secondary&0x0f == PRINTER_SA_LOWER
+	default:
+		p.listening = true
+	}
+}
+
+func (p *Printer) Unlisten() {
+	p.listening = false
+}
+
+func (p *Printer) Talk(secondary Byte) {
+}
+
+func (p *Printer) Untalk() {
+}
+
+// Send does nothing; the printer never talks
+func (p *Printer) Send() (Byte, bool, bool) {
+	return 0, false, false
+}
+
+func (p *Printer) Receive(data Byte, eoi bool) {
+	if !p.listening {
+		return
+	}
+	if p.pages == nil {
+		p.pages = []printerPage{{}}
+		p.line = nil
+		p.rvs = false
+	}
+
+	p.idle = 0
+	c := byte(data)
+	lastCR := p.lastCR
+	p.lastCR = false
+
+	switch c {
+	case PRINTER_CR:
+		p.newLine()
+		p.rvs = false
+		p.lastCR = true
+	case PRINTER_LF:
+		// CR LF is a single new line
+		if !lastCR {
+			p.newLine()
+		}
+	case PRINTER_FF:
+		p.newLine()
+		p.pages = append(p.pages, printerPage{})
+	case PRINTER_LOWER:
+		p.lower = true
+	case PRINTER_UPPER:
+		p.lower = false
+	case PRINTER_RVS_ON:
+		p.rvs = true
+	case PRINTER_RVS_OFF:
+		p.rvs = false
+	default:
+		if _, ok := petsciiToScreen(c); !ok {
+			// Other control characters are ignored
+			break
+		}
+		if len(p.line) == PRINTER_COLUMNS {
+			p.newLine()
+		}
+		p.line = append(p.line, printerCell{c, p.lower, p.rvs})
+	}
+}
+
+// Tick ends the current job once the printer has been idle
+func (p *Printer) Tick(cycles int) {
+	if p.pages == nil {
+		return
+	}
+	p.idle += cycles
+	if p.idle >= PRINTER_IDLE {
+		err := p.endJob()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "printer: %s\n", err)
+		}
+	}
+}
+
+// newLine moves to a new line, & to a new page at the bottom of the page
+func (p *Printer) newLine() {
+	page := &p.pages[len(p.pages)-1]
+	*page = append(*page, p.line)
+	p.line = nil
+	if len(*page) == PRINTER_LINES {
+		p.pages = append(p.pages, printerPage{})
+	}
+}
+
+// Flush ends any job in progress
+func (p *Printer) Flush() error {
+	return p.endJob()
+}
+
+// endJob writes the current job to the output files
+func (p *Printer) endJob() error {
+	if p.pages == nil {
+		return nil
+	}
+	if len(p.line) > 0 {
+		p.newLine()
+	}
+	pages := p.pages
+	p.pages = nil
+
+	// Drop the empty page after a final form feed
+	if len(pages) > 1 && len(pages[len(pages)-1]) == 0 {
+		pages = pages[:len(pages)-1]
+	}
+
+	// Find an unused job number, so earlier output is not overwritten
+	var base string
+	for {
+		p.job++
+		base = fmt.Sprintf("%s-%03d", p.Base, p.job)
+		if _, err := os.Stat(base + ".txt"); os.IsNotExist(err) {
+			break
+		}
+	}
+
+	err := p.writeText(base+".txt", pages)
+	if err != nil {
+		return err
+	}
+	if p.PNG {
+		for n, page := range pages {
+			filename := fmt.Sprintf("%s-%d.png", base, n+1)
+			if len(pages) == 1 {
+				filename = base + ".png"
+			}
+			err = p.writePNG(filename, page)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeText writes the pages as UTF-8 text, with a form feed between pages
+func (p *Printer) writeText(filename string, pages []printerPage) error {
+	var sb strings.Builder
+	for n, page := range pages {
+		if n > 0 {
+			sb.WriteByte('\f')
+		}
+		for _, line := range page {
+			for _, cell := range line {
+				r, _ := petsciiToRune(cell.c, cell.lower)
+				sb.WriteRune(r)
+			}
+			sb.WriteByte('\n')
+		}
+	}
+	return os.WriteFile(filename, []byte(sb.String()), 0644)
+}
+
+// writePNG draws a page with the character ROM
+func (p *Printer) writePNG(filename string, page printerPage) error {
+	palette := color.Palette{color.White, color.Black}
+	img := image.NewPaletted(image.Rect(0, 0, PRINTER_COLUMNS*8, PRINTER_LINES*char_h), palette)
+
+	for y, line := range page {
+		for x, cell := range line {
+			sc, _ := petsciiToScreen(cell.c)
+			for l := 0; l < char_h; l++ {
+				romAddr := Word(sc&0x7f)<<3 | Word(l)
+				if cell.lower {
+					romAddr |= 0x400
+				}
+				bits := p.ROM.Read(romAddr)
+				if cell.reverse {
+					bits = ^bits
+				}
+				for b := 0; b < 8; b++ {
+					if (bits<<b)&0x80 != 0 {
+						img.SetColorIndex(x*8+b, y*char_h+l, 1)
+					}
+				}
+			}
+		}
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, img)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
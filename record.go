@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Screenshots taken with the hotkey are written to SCREENSHOT_BASE-NNN.png
+const SCREENSHOT_BASE = "pet"
+
+// SavePNG writes an image to a PNG file
+func SavePNG(filename string, img image.Image) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, img)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// screenshotName returns the name of the next screenshot in the current
+// directory, which doesn't overwrite an earlier one
+func screenshotName() string {
+	for n := 1; ; n++ {
+		filename := fmt.Sprintf("%s-%03d.png", SCREENSHOT_BASE, n)
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return filename
+		}
+	}
+}
+
+/*
+Recorder writes every frame the PET displays, drawn as it appears on the
+monitor, to a video file. The file is an animated GIF if the filename ends in
+.gif, & otherwise a stream of PPM images, which can be a named pipe to ffmpeg
+E.g.
+
+	mkfifo video.ppm
+	ffmpeg -framerate 60.1 -f image2pipe -c:v ppm -i video.ppm pet.mp4 &
+	pet -record video.ppm
+
+Frames are recorded in emulated time, from the start, so the sound written
+with -wav plays in step with them.
+
+A GIF is written as it is recorded. Only the area which has changed is stored
+for each frame, & a frame which is the same as the last extends it, so a
+screen which changes little makes a small file.
+*/
+type Recorder struct {
+	Display *Display // Draws the frames
+
+	file  *os.File
+	out   *bufio.Writer
+	isGIF bool
+
+	gif     *GIFWriter      // Written once the size of the first frame is known
+	last    *image.Paletted // Last GIF frame, written once its delay is known
+	palette color.Palette   // GIF colours; brightnesses of the phosphor
+	time    float64         // Time recorded, in seconds
+	delays  int             // Sum of the GIF frame delays, in 1/100ths of a second
+	frames  int             // Frames recorded
+	err     error           // First error writing the file
+}
+
+// NewRecorder creates a video file
+func NewRecorder(filename string, display *Display) (*Recorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		Display: display,
+		file:    file,
+		out:     bufio.NewWriter(file),
+	}
+	if strings.EqualFold(filepath.Ext(filename), ".gif") {
+		r.isGIF = true
+
+		// Every pixel is the phosphor colour at some brightness
+		p := display.CRT.Phosphor
+		for n := 0; n < 256; n++ {
+			r.palette = append(r.palette, color.RGBA{
+				R: uint8(int(p.R) * n / 255),
+				G: uint8(int(p.G) * n / 255),
+				B: uint8(int(p.B) * n / 255),
+				A: 0xff,
+			})
+		}
+	}
+	return r, nil
+}
+
+// Frame draws & records a frame
+func (r *Recorder) Frame(f *Frame) {
+	if r.err != nil {
+		return
+	}
+	img, dirty := r.Display.Render(f)
+	if r.frames == 0 {
+		fmt.Fprintf(os.Stderr, "record: %.2f frames per second\n", CPU_CLOCK/float64(f.Cycles))
+	}
+	r.frames++
+
+	if r.isGIF {
+		r.err = r.gifFrame(img, dirty)
+	} else {
+		r.err = r.ppmFrame(img)
+	}
+	r.time += float64(f.Cycles) / CPU_CLOCK
+}
+
+// ppmFrame writes a frame as a PPM image
+func (r *Recorder) ppmFrame(img *image.RGBA) error {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	_, err := fmt.Fprintf(r.out, "P6\n%d %d\n255\n", width, height)
+	if err != nil {
+		return err
+	}
+	rgb := make([]byte, 0, width*3)
+	for y := 0; y < height; y++ {
+		rgb = rgb[:0]
+		row := img.Pix[y*img.Stride : y*img.Stride+width*4]
+		for x := 0; x < len(row); x += 4 {
+			rgb = append(rgb, row[x], row[x+1], row[x+2])
+		}
+		_, err = r.out.Write(rgb)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gifFrame adds the area of a frame which has changed to the GIF
+func (r *Recorder) gifFrame(img *image.RGBA, dirty image.Rectangle) error {
+	if r.last != nil && dirty.Empty() {
+		return nil
+	}
+	err := r.endGIFFrame()
+	if err != nil {
+		return err
+	}
+	if r.gif == nil {
+		// The first frame covers the whole image
+		dirty = img.Rect
+		r.gif, err = NewGIFWriter(r.out, img.Rect.Dx(), img.Rect.Dy(), r.palette)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The channel which is brightest in the phosphor gives the brightness
+	p := r.Display.CRT.Phosphor
+	ch, max := 0, p.R
+	if p.G > max {
+		ch, max = 1, p.G
+	}
+	if p.B > max {
+		ch, max = 2, p.B
+	}
+
+	frame := image.NewPaletted(dirty, r.palette)
+	for y := dirty.Min.Y; y < dirty.Max.Y; y++ {
+		for x := dirty.Min.X; x < dirty.Max.X; x++ {
+			level := int(img.Pix[img.PixOffset(x, y)+ch])
+			if max > 0 {
+				level = (level*255 + int(max)/2) / int(max)
+			}
+			if level > 255 {
+				level = 255
+			}
+			frame.Pix[frame.PixOffset(x, y)] = uint8(level)
+		}
+	}
+	r.last = frame
+	return nil
+}
+
+// endGIFFrame writes the last GIF frame, which lasts until now. Delays are
+// rounded so that their sum keeps time with the PET.
+func (r *Recorder) endGIFFrame() error {
+	if r.last == nil {
+		return nil
+	}
+	delay := int(math.Round(r.time*100)) - r.delays
+	r.delays += delay
+	err := r.gif.WriteFrame(r.last, delay)
+	r.last = nil
+	return err
+}
+
+// Close finishes the video file
+func (r *Recorder) Close() error {
+	if r.err == nil && r.gif != nil {
+		r.err = r.endGIFFrame()
+		if r.err == nil {
+			r.err = r.gif.Close()
+		}
+	}
+	if r.err == nil {
+		r.err = r.out.Flush()
+	}
+	if r.err != nil {
+		r.file.Close()
+		return r.err
+	}
+	fmt.Fprintf(os.Stderr, "record: %d frames\n", r.frames)
+	return r.file.Close()
+}
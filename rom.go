@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 )
 
@@ -39,17 +40,27 @@ func (r *ROM) Write(Word, Byte) {
 	// ROM
 }
 
-func (r *ROM) Load(filename string) {
+func (r *ROM) Load(filename string) error {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if Word(len(data)) > r.Size {
-		panic("can't load that there (too big)")
+	err = r.LoadData(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// LoadData copies the ROM image into the ROM
+func (r *ROM) LoadData(data []byte) error {
+	if len(data) > int(r.Size) {
+		return fmt.Errorf("can't load at $%04x: %d bytes is too big for a %d byte ROM", r.Base, len(data), r.Size)
 	}
 	for n := 0; n < len(data); n++ {
 		r.mem[Word(n)] = Byte(data[n])
 	}
+	return nil
 }
 
 func (r *ROM) ReadVector(address Word) Word {
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha1"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variable with a list of directories to search for ROM images
+const ENV_ROMDIR = "PET_ROMDIR"
+
+// Editor ROM of the 80 column PETs, which isn't built in
+const EDITOR_80_COLUMNS = "edit-4-80-b-60Hz.901474-03.bin"
+
+// Fallback ROM images, built into the executable
+//
+//go:embed roms
+var embeddedROMs embed.FS
+
+// ROMInfo identifies a known ROM image
+type ROMInfo struct {
+	Part     string // Commodore part number
+	Name     string // Description
+	Filename string // Standard image filename
+	Size     int    // Image size
+	CRC32    uint32 // CRC32 of the image
+	SHA1     string // SHA1 of the image
+}
+
+var knownROMs = []ROMInfo{
+	// BASIC 1 ("ROM 3")
+	{"901447-20", "BASIC 1 $C000", "rom-3-c000.901447-20.bin", 2048, 0x6aab64a5, "8b26c86586787cd615c72f858307d18147872fb3"},
+	{"901447-21", "BASIC 1 $C800", "rom-3-c800.901447-21.bin", 2048, 0xa8f6ff4c, "89639e3dbf517eeac7b307ba59df708c99728e66"},
+	{"901447-22", "BASIC 1 $D000", "rom-3-d000.901447-22.bin", 2048, 0x97f7396a, "1f5abdcbb305e08ca3d352eadcff6a58542d86d7"},
+	{"901447-23", "BASIC 1 $D800", "rom-3-d800.901447-23.bin", 2048, 0x4cf8724c, "0be048cd378625afd99338ada53bde434cc4613f"},
+	{"901447-24", "Editor 1/2 $E000 (normal keyboard)", "edit-2-n.901447-24.bin", 2048, 0xe459ab32, "5e5502ce32f5a7e387d65efe058916282041e54b"},
+	{"901447-25", "Kernal 1 $F000", "rom-3-f000.901447-25.bin", 2048, 0x8745fc8a, "fcc939d58c9bda5b54d6fb818ed4d0804e5ac377"},
+	{"901447-26", "Kernal 1 $F800", "rom-3-f800.901447-26.bin", 2048, 0xfd2c1f87, "4081e365ff53bd5b8675a232a4793f6a1d087543"},
+
+	// BASIC 2
+	{"901465-01", "BASIC 2 $C000", "basic-2-c000.901465-01.bin", 4096, 0x63a7fe4a, "3622111f486d0e137022523657394befa92bde44"},
+	{"901465-02", "BASIC 2 $D000", "basic-2-d000.901465-02.bin", 4096, 0xae4cb035, "1bc0ebf27c9bb62ad71bca40313e874234cab6ac"},
+	{"901465-03", "Kernal 2 $F000", "kernal-2.901465-03.bin", 4096, 0xf02238e2, "38742bdf449f629bcba6276ef24d3daeb7da6e84"},
+
+	// BASIC 4
+	{"901465-23", "BASIC 4 $B000", "basic-4-b000.901465-23.bin", 4096, 0xae3deac0, "975ee25e28ff302879424587e5fb4ba19f403adc"},
+	{"901465-20", "BASIC 4 $C000", "basic-4-c000.901465-20.bin", 4096, 0x0fc17b9c, "242f98298931d21eaacb55fe635e44b7fc192b0a"},
+	{"901465-21", "BASIC 4 $D000", "basic-4-d000.901465-21.bin", 4096, 0x36d91855, "1bb236c72c726e8fb029c68f9bfa5ee803faf0a8"},
+	{"901498-01", "Editor 4 $E000 (40 columns with CRTC, normal keyboard, 50Hz)", "edit-4-40-n-50Hz.901498-01.bin", 2048, 0x3370e359, "05af284c914d53a52987b5f602466de75765f650"},
+	{"901465-22", "Kernal 4 $F000", "kernal-4.901465-22.bin", 4096, 0xcc5298a1, "96a0fa56e0c937da92971d9c99d504e44e898806"},
+
+	// Character generator
+	{"901447-10", "Character generator", "char-901447-10.bin", 2048, 0xd8408674, "0157a2d55b7ac4eaeb38475889ebeea52e2593db"},
+
+	// Diagnostics
+	{"", "Diagnostic $F000 (U-2)", "U-2 DIA", 2048, 0xa9432371, "c58ae8b68de2d504b53381cde1a7bf37ab749de2"},
+	{"", "Diagnostic $F800 (U-3)", "U-3 DIA", 2048, 0xfbd3b9b3, "c05a2771049679da9ad2345b085a9a62b3d5c87e"},
+}
+
+func (i *ROMInfo) String() string {
+	if i.Part == "" {
+		return i.Name
+	}
+	return fmt.Sprintf("%s (%s)", i.Name, i.Part)
+}
+
+// IdentifyROM returns the known ROM which matches the image, or nil if the
+// image is unknown
+func IdentifyROM(data []byte) *ROMInfo {
+	crc := crc32.ChecksumIEEE(data)
+	sum := sha1.Sum(data)
+	sha := hex.EncodeToString(sum[:])
+
+	for n := range knownROMs {
+		info := &knownROMs[n]
+		if info.Size == len(data) && info.CRC32 == crc && info.SHA1 == sha {
+			return info
+		}
+	}
+	return nil
+}
+
+// lookupROM returns the known ROM with the given standard filename, or nil
+func lookupROM(filename string) *ROMInfo {
+	for n := range knownROMs {
+		if knownROMs[n].Filename == filename {
+			return &knownROMs[n]
+		}
+	}
+	return nil
+}
+
+// ROMSet finds, identifies & loads ROM images
+type ROMSet struct {
+	Paths  []string  // Directories to search, in order
+	Writer io.Writer // io.Writer for warnings
+}
+
+/*
+NewROMSet creates a ROMSet. Find tries a filename as given, & then searches
+for it in:
+
+ 1. romdir, if set
+ 2. The directories listed in $PET_ROMDIR
+ 3. $XDG_DATA_HOME/pet/roms
+ 4. pet/roms under each of the directories in $XDG_DATA_DIRS
+ 5. roms next to the executable
+ 6. roms in the current directory
+
+If an image isn't found in any of them, the built-in copy is used.
+*/
+func NewROMSet(romdir string, w io.Writer) *ROMSet {
+	s := &ROMSet{
+		Writer: w,
+	}
+
+	if romdir != "" {
+		s.Paths = append(s.Paths, romdir)
+	}
+	s.Paths = append(s.Paths, filepath.SplitList(os.Getenv(ENV_ROMDIR))...)
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			dataHome = filepath.Join(home, ".local", "share")
+		}
+	}
+	if dataHome != "" {
+		s.Paths = append(s.Paths, filepath.Join(dataHome, "pet", "roms"))
+	}
+
+	dataDirs := os.Getenv("XDG_DATA_DIRS")
+	if dataDirs == "" {
+		dataDirs = "/usr/local/share:/usr/share"
+	}
+	for _, dir := range filepath.SplitList(dataDirs) {
+		s.Paths = append(s.Paths, filepath.Join(dir, "pet", "roms"))
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		s.Paths = append(s.Paths, filepath.Join(filepath.Dir(exe), "roms"))
+	}
+	s.Paths = append(s.Paths, "roms")
+
+	return s
+}
+
+func (s *ROMSet) warn(format string, a ...any) {
+	if s.Writer != nil {
+		fmt.Fprintf(s.Writer, "warning: "+format+"\n", a...)
+	}
+}
+
+// Find returns the contents of the named ROM image & where it was found.
+// The filename is tried as given first, so a file in the current directory
+// is found E.g. -rom9 toolkit.bin. A filename that includes a directory is
+// only read as-is, otherwise the search path is used.
+func (s *ROMSet) Find(filename string) ([]byte, string, error) {
+	data, err := os.ReadFile(filename)
+	if err == nil || strings.ContainsRune(filename, filepath.Separator) {
+		return data, filename, err
+	}
+
+	for _, dir := range s.Paths {
+		p := filepath.Join(dir, filename)
+		data, err := os.ReadFile(p)
+		if err == nil {
+			return data, p, nil
+		}
+	}
+
+	// Fallback to the built-in images
+	p := path.Join("roms", filename)
+	data, err = fs.ReadFile(embeddedROMs, p)
+	if err == nil {
+		return data, "built-in " + p, nil
+	}
+
+	return nil, "", fmt.Errorf("can't find ROM image %q in the current directory or any of: %s", filename, strings.Join(s.Paths, ", "))
+}
+
+// Load finds the named ROM image, checks it & loads it into rom
+func (s *ROMSet) Load(rom *ROM, filename string) error {
+	data, where, err := s.Find(filename)
+	if err != nil {
+		return err
+	}
+
+	// Check the image is what we expected
+	expected := lookupROM(filepath.Base(filename))
+	actual := IdentifyROM(data)
+	switch {
+	case actual == nil && expected != nil:
+		s.warn("%s does not match %s; the image may be corrupted", where, expected)
+	case actual == nil:
+		s.warn("%s is an unknown ROM image (CRC32 %08x)", where, crc32.ChecksumIEEE(data))
+	case expected != nil && actual != expected:
+		s.warn("%s is %s, not %s", where, actual, expected)
+	}
+
+	err = rom.LoadData(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", where, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Bit of a screen code which selects the reverse video character
+const SCREEN_REVERSE = 0x80
+
+// ANSI escape sequences for reverse video, used by WriteScreen
+const (
+	ANSI_REVERSE = "\x1b[7m"
+	ANSI_NORMAL  = "\x1b[27m"
+)
+
+// Span is a run of columns in a row of the screen, from Start up to, but not
+// including, End
+type Span struct {
+	Start, End int
+}
+
+// ScreenRow is the text of a row of the screen
+type ScreenRow struct {
+	Text    string // One Unicode character for each column
+	Reverse []Span // Runs of characters shown in reverse video
+}
+
+// IsReverse returns true if the character in a column is shown in reverse
+// video
+func (r ScreenRow) IsReverse(col int) bool {
+	for _, span := range r.Reverse {
+		if col >= span.Start && col < span.End {
+			return true
+		}
+	}
+	return false
+}
+
+// screenRune converts a screen code to Unicode, in the upper case & graphics
+// character set or, if lower is set, the lower & upper case set
+func screenRune(code Byte, lower bool) rune {
+	r, _ := petsciiToRune(screenToPETSCII(byte(code&^SCREEN_REVERSE)), lower)
+	return r
+}
+
+/*
+Text returns the text of the frame, a row at a time. Graphics characters are
+mapped to the Unicode block drawing & Symbols for Legacy Computing characters,
+& letters to the case they are shown in by the selected character set. Reverse
+video is reported separately, so characters which differ only in reverse video
+have the same text. A CRTC which inverts the screen swaps normal & reverse
+video.
+*/
+func (f *Frame) Text() []ScreenRow {
+	rows := make([]ScreenRow, f.Rows)
+	for row := range rows {
+		var text strings.Builder
+		var reverse []Span
+		for col := 0; col < f.Columns; col++ {
+			code := f.Screen[row*f.Columns+col]
+			text.WriteRune(screenRune(code, f.Lower))
+
+			if (code&SCREEN_REVERSE != 0) != f.Inverted {
+				if n := len(reverse); n > 0 && reverse[n-1].End == col {
+					reverse[n-1].End++
+				} else {
+					reverse = append(reverse, Span{col, col + 1})
+				}
+			}
+		}
+		rows[row] = ScreenRow{Text: text.String(), Reverse: reverse}
+	}
+	return rows
+}
+
+// Text returns the text on the screen now. It reads the screen memory, so it
+// must be called by the goroutine running the CPU.
+func (v *Video) Text() []ScreenRow {
+	f := Frame{}
+	v.read(&f)
+	return f.Text()
+}
+
+// WriteScreen writes the text of the screen, without trailing spaces. If ansi
+// is set, reverse video is shown with ANSI escape sequences, & otherwise it is
+// left out.
+func WriteScreen(w io.Writer, rows []ScreenRow, ansi bool) error {
+	for _, row := range rows {
+		var line strings.Builder
+		end := 0 // Length of the line up to the last character which is shown
+		col := 0
+		for _, r := range row.Text {
+			reverse := ansi && row.IsReverse(col)
+			if reverse && (col == 0 || !row.IsReverse(col-1)) {
+				line.WriteString(ANSI_REVERSE)
+			}
+			line.WriteRune(r)
+			if reverse && !row.IsReverse(col+1) {
+				line.WriteString(ANSI_NORMAL)
+			}
+			if r != ' ' || reverse {
+				end = line.Len()
+			}
+			col++
+		}
+		_, err := fmt.Fprintln(w, line.String()[:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
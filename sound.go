@@ -0,0 +1,83 @@
+package main
+
+const (
+	CPU_CLOCK   = 1000000 // 1MHz system clock
+	SAMPLE_RATE = 44100   // Audio sample rate
+
+	// Amplitude of the generated audio
+	soundLevel = 8192
+
+	// Number of samples to buffer before they are written
+	soundBufferSize = 1024
+)
+
+// AudioSink consumes a stream of mono 16bit audio samples
+type AudioSink interface {
+	WriteSamples(samples []int16) error
+}
+
+/*
+Sound turns the state of the VIA CB2 line into a stream of audio samples. The
+PET has no sound hardware as such; programs make sound by running the VIA shift
+register in free-running mode, which produces a square wave on CB2.
+*/
+type Sound struct {
+	CB2   func() Byte // Returns the current status of the VIA CB2 line
+	Sinks []AudioSink // Destinations for the audio
+
+	phase  int // Sample clock phase
+	cycles int // Number of cycles in the current sample
+	high   int // Number of cycles CB2 was high in the current sample
+
+	// High pass filter state, to remove the DC offset
+	lastIn  float64
+	lastOut float64
+
+	buf []int16
+}
+
+// Tick samples CB2 for the given number of clock cycles
+func (s *Sound) Tick(cycles int) {
+	level := s.CB2()
+	for n := 0; n < cycles; n++ {
+		s.cycles++
+		if level != 0 {
+			s.high++
+		}
+
+		// Emit a sample each time the sample clock passes the system clock
+		s.phase += SAMPLE_RATE
+		if s.phase >= CPU_CLOCK {
+			s.phase -= CPU_CLOCK
+			s.emit()
+		}
+	}
+}
+
+// emit adds a sample, which is the average level of CB2 over the sample
+// period
+func (s *Sound) emit() {
+	in := float64(2*s.high-s.cycles) / float64(s.cycles)
+	s.cycles, s.high = 0, 0
+
+	out := in - s.lastIn + 0.995*s.lastOut
+	s.lastIn, s.lastOut = in, out
+
+	s.buf = append(s.buf, int16(out*soundLevel))
+	if len(s.buf) >= soundBufferSize {
+		s.Flush()
+	}
+}
+
+// Flush writes any buffered samples to the sinks
+func (s *Sound) Flush() error {
+	var err error
+	for _, sink := range s.Sinks {
+		e := sink.WriteSamples(s.buf)
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	s.buf = s.buf[:0]
+	return err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// T64 archive layout
+const (
+	T64_SIGNATURE   = "C64" // Start of the signature E.g. "C64S tape file"
+	T64_HEADER_SIZE = 0x40
+	T64_MAX_ENTRIES = 0x22 // Offset of the number of directory entries
+	T64_USED        = 0x24 // Offset of the number of used entries
+	T64_NAME        = 0x28 // Offset of the tape name
+	T64_NAME_LEN    = 24
+	T64_ENTRY_SIZE  = 32
+)
+
+// T64 directory entry types
+const (
+	T64_FREE     = 0x00
+	T64_TAPE     = 0x01 // Normal tape file
+	T64_SNAPSHOT = 0x02 // Tape file with header, or memory snapshot
+)
+
+// T64Entry is a file in a T64 archive
+type T64Entry struct {
+	Type     Byte   // Entry type E.g. T64_TAPE
+	FileType Byte   // CBM DOS file type E.g. FILE_CLOSED|FILE_PRG
+	Start    Word   // Load address
+	End      Word   // Address after the last byte
+	Offset   int    // Offset of the data in the archive
+	Name     []byte // PETSCII filename, without padding
+}
+
+func (e *T64Entry) TypeName() string {
+	t := int(e.FileType & FILE_TYPE)
+	if t < len(fileTypes) && t != FILE_DEL {
+		return fileTypes[t]
+	}
+	// Many archives don't set the file type of programs
+	return fileTypes[FILE_PRG]
+}
+
+// Size returns the number of bytes of data, without the load address
+func (e *T64Entry) Size() int {
+	return int(e.End) - int(e.Start)
+}
+
+/*
+T64 is a tape archive, which holds the files from a tape with the load address
+of each. Archives are often created with the wrong end addresses, so the size
+of each file is limited to the data before the next file in the archive.
+*/
+type T64 struct {
+	Name    []byte      // PETSCII tape name, without padding
+	Entries []*T64Entry // Files, in directory order
+
+	data []byte
+}
+
+// IsT64 returns true if the data looks like a T64 archive
+func IsT64(data []byte) bool {
+	return len(data) >= T64_HEADER_SIZE && bytes.HasPrefix(data, []byte(T64_SIGNATURE))
+}
+
+// OpenT64 reads a T64 archive
+func OpenT64(filename string) (*T64, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ParseT64(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return t, nil
+}
+
+// ParseT64 reads the directory of a T64 archive
+func ParseT64(data []byte) (*T64, error) {
+	if !IsT64(data) {
+		return nil, errors.New("not a T64 archive")
+	}
+	t := &T64{
+		Name: trimName(data[T64_NAME : T64_NAME+T64_NAME_LEN]),
+		data: data,
+	}
+
+	// The number of used entries is often wrong, so all entries are read
+	max := int(binary.LittleEndian.Uint16(data[T64_MAX_ENTRIES:]))
+	for n := 0; n < max; n++ {
+		offset := T64_HEADER_SIZE + n*T64_ENTRY_SIZE
+		if offset+T64_ENTRY_SIZE > len(data) {
+			break
+		}
+		entry := data[offset : offset+T64_ENTRY_SIZE]
+		if entry[0] == T64_FREE {
+			continue
+		}
+		t.Entries = append(t.Entries, &T64Entry{
+			Type:     Byte(entry[0]),
+			FileType: Byte(entry[1]),
+			Start:    Word(binary.LittleEndian.Uint16(entry[2:])),
+			End:      Word(binary.LittleEndian.Uint16(entry[4:])),
+			Offset:   int(binary.LittleEndian.Uint32(entry[8:])),
+			Name:     trimName(entry[16:32]),
+		})
+	}
+	if len(t.Entries) == 0 {
+		return nil, errors.New("no files in T64 archive")
+	}
+
+	// Limit each file to the data before the next one
+	for _, e := range t.Entries {
+		if e.Offset > len(data) {
+			return nil, fmt.Errorf("T64 entry %q is past the end of the archive", petsciiToASCIIString(e.Name))
+		}
+		limit := len(data)
+		for _, next := range t.Entries {
+			if next.Offset > e.Offset && next.Offset < limit {
+				limit = next.Offset
+			}
+		}
+		if e.Size() <= 0 || e.Offset+e.Size() > limit {
+			// The file can't load past the top of memory
+			size := limit - e.Offset
+			if size > 0xffff-int(e.Start) {
+				size = 0xffff - int(e.Start)
+			}
+			e.End = e.Start + Word(size)
+		}
+	}
+	return t, nil
+}
+
+// trimName removes the padding from a name
+func trimName(name []byte) []byte {
+	return bytes.TrimRight(name, "\x20\xa0\x00")
+}
+
+// petsciiToASCIIString converts a PETSCII name to ASCII, for messages
+func petsciiToASCIIString(name []byte) string {
+	ascii := make([]byte, len(name))
+	for n, c := range name {
+		ascii[n] = petsciiToASCII(c)
+	}
+	return string(ascii)
+}
+
+// Find returns the first file whose name starts with the given name, as a tape
+// does. The name may contain wildcards. An empty name matches the first file.
+func (t *T64) Find(name []byte) *T64Entry {
+	pattern := append(append([]byte{}, name...), '*')
+	for _, e := range t.Entries {
+		if matchName(pattern, e.Name) {
+			return e
+		}
+	}
+	return nil
+}
+
+// PRG returns a file as a PRG, with the load address in the first two bytes
+func (t *T64) PRG(e *T64Entry) []byte {
+	prg := []byte{byte(e.Start), byte(e.Start >> 8)}
+	return append(prg, t.data[e.Offset:e.Offset+e.Size()]...)
+}
+
+// List writes the directory of the archive
+func (t *T64) List(w io.Writer) {
+	fmt.Fprintf(w, "%q\n", petsciiToASCIIString(t.Name))
+	for _, e := range t.Entries {
+		fmt.Fprintf(w, "%-18q %s $%04x-$%04x %5d\n",
+			petsciiToASCIIString(e.Name), e.TypeName(), e.Start, e.End, e.Size())
+	}
+}
+
+// Extract writes each file in the archive to a PRG file in a directory
+func (t *T64) Extract(dir string) error {
+	for _, e := range t.Entries {
+		filename := filepath.Join(dir, hostName(e.Name, FILE_PRG))
+		err := os.WriteFile(filename, t.PRG(e), 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d bytes\n", filename, e.Size()+DATA_START)
+	}
+	return nil
+}
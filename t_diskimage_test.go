@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// newTestImage returns an empty, validated disk image in memory, which is
+// saved to a temporary file
+func newTestImage(t *testing.T, f *DiskFormat) *DiskImage {
+	d := &DiskImage{
+		Filename: filepath.Join(t.TempDir(), "test."+f.Name),
+		Format:   f,
+		data:     make([]byte, f.Size),
+	}
+	name := d.DiskName()
+	for n := range name {
+		name[n] = FILENAME_PAD
+	}
+	copy(name, "TEST")
+
+	// The directory is a single empty block
+	dir, _ := d.block(f.DirTrack, 1)
+	dir[0], dir[1] = 0x00, 0xff
+
+	err := d.Validate()
+	if err != nil {
+		t.Fatalf("%s: validate: %s", f.Name, err)
+	}
+	return d
+}
+
+// testData returns a file of the given size
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for n := range data {
+		data[n] = byte(n * 7)
+	}
+	return data
+}
+
+// files returns the directory entries which are in use
+func files(t *testing.T, d Disk) []*DirEntry {
+	entries, err := d.Directory()
+	if err != nil {
+		t.Fatalf("directory: %s", err)
+	}
+	used := []*DirEntry{}
+	for _, e := range entries {
+		if e.Type != FILE_DEL {
+			used = append(used, e)
+		}
+	}
+	return used
+}
+
+func Test_diskFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format *DiskFormat
+		blocks int
+		free   int
+		track  int
+		sector int // Sectors on the track
+	}{
+		{FORMAT_D64, 683, 664, 18, 19},
+		{FORMAT_D64, 683, 664, 35, 17},
+		{FORMAT_D80, 2083, 2052, 39, 29},
+		{FORMAT_D80, 2083, 2052, 54, 25},
+		{FORMAT_D82, 4166, 4133, 116, 29},
+		{FORMAT_D82, 4166, 4133, 154, 23},
+	} {
+		total := 0
+		for track := 1; track <= tc.format.Tracks; track++ {
+			total += tc.format.Sectors(track)
+		}
+		if total != tc.blocks || tc.format.Blocks() != tc.blocks {
+			t.Errorf("%s: blocks: got %d & %d, expected %d", tc.format.Name, total, tc.format.Blocks(), tc.blocks)
+		}
+		if n := tc.format.Sectors(tc.track); n != tc.sector {
+			t.Errorf("%s: track %d: got %d sectors, expected %d", tc.format.Name, tc.track, n, tc.sector)
+		}
+		if free := newTestImage(t, tc.format).BlocksFree(); free != tc.free {
+			t.Errorf("%s: got %d blocks free, expected %d", tc.format.Name, free, tc.free)
+		}
+	}
+}
+
+func Test_diskImageFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		size   int
+		blocks int
+	}{
+		{"EMPTY", 0, 1},
+		{"ONE BLOCK", BLOCK_DATA, 1},
+		{"TWO BLOCKS", BLOCK_DATA + 1, 2},
+		{"LONGER PROGRAM", 10000, 40},
+	} {
+		for _, f := range diskFormats {
+			d := newTestImage(t, f)
+			free := d.BlocksFree()
+			data := testData(tc.size)
+
+			// Write
+			err := d.WriteFile([]byte(tc.name), FILE_PRG, data)
+			if err != nil {
+				t.Fatalf("%s %s: write: %s", f.Name, tc.name, err)
+			}
+			if d.BlocksFree() != free-tc.blocks {
+				t.Errorf("%s %s: got %d blocks free, expected %d", f.Name, tc.name, d.BlocksFree(), free-tc.blocks)
+			}
+
+			// Read back
+			entries := files(t, d)
+			if len(entries) != 1 {
+				t.Fatalf("%s %s: got %d files, expected 1", f.Name, tc.name, len(entries))
+			}
+			e := entries[0]
+			if string(e.Name) != tc.name || e.Type != FILE_CLOSED|FILE_PRG || e.Blocks != tc.blocks {
+				t.Errorf("%s %s: got entry %q %s %d blocks", f.Name, tc.name, e.Name, e.TypeName(), e.Blocks)
+			}
+			read, err := d.ReadFile(e)
+			if err != nil {
+				t.Fatalf("%s %s: read: %s", f.Name, tc.name, err)
+			}
+			if !bytes.Equal(read, data) {
+				t.Errorf("%s %s: read %d bytes which differ from the %d written", f.Name, tc.name, len(read), len(data))
+			}
+
+			// Validating a consistent disk changes nothing
+			err = d.Validate()
+			if err != nil {
+				t.Fatalf("%s %s: validate: %s", f.Name, tc.name, err)
+			}
+			if d.BlocksFree() != free-tc.blocks {
+				t.Errorf("%s %s: validate: got %d blocks free, expected %d", f.Name, tc.name, d.BlocksFree(), free-tc.blocks)
+			}
+
+			// Scratch
+			err = d.Scratch(e)
+			if err != nil {
+				t.Fatalf("%s %s: scratch: %s", f.Name, tc.name, err)
+			}
+			if len(files(t, d)) != 0 || d.BlocksFree() != free {
+				t.Errorf("%s %s: scratch: got %d files & %d blocks free", f.Name, tc.name, len(files(t, d)), d.BlocksFree())
+			}
+		}
+	}
+}
+
+func Test_diskImageDirectory(t *testing.T) {
+	d := newTestImage(t, FORMAT_D64)
+	free := d.BlocksFree()
+
+	// Eight entries fill a directory block, so the ninth extends it
+	for n := 0; n < 9; n++ {
+		err := d.WriteFile([]byte{'F', 'I', 'L', 'E', byte('1' + n)}, FILE_SEQ, testData(100))
+		if err != nil {
+			t.Fatalf("write %d: %s", n, err)
+		}
+	}
+	entries := files(t, d)
+	if len(entries) != 9 {
+		t.Fatalf("got %d files, expected 9", len(entries))
+	}
+	if entries[8].dirTrack != FORMAT_D64.DirTrack || entries[8].dirSector == 1 {
+		t.Errorf("ninth entry is at %d,%d, not in a new directory block", entries[8].dirTrack, entries[8].dirSector)
+	}
+	if d.BlocksFree() != free-9 {
+		t.Errorf("got %d blocks free, expected %d", d.BlocksFree(), free-9)
+	}
+
+	// Rename
+	err := d.Rename(entries[0], []byte("RENAMED"))
+	if err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if name := files(t, d)[0].Name; string(name) != "RENAMED" {
+		t.Errorf("rename: got %q", name)
+	}
+
+	// Validate removes a file which wasn't closed, & frees its blocks
+	d.dirEntry(entries[1])[2] = FILE_SEQ
+	err = d.Validate()
+	if err != nil {
+		t.Fatalf("validate: %s", err)
+	}
+	if len(files(t, d)) != 8 || d.BlocksFree() != free-8 {
+		t.Errorf("validate: got %d files & %d blocks free, expected 8 & %d", len(files(t, d)), d.BlocksFree(), free-8)
+	}
+}
+
+func Test_diskImageFull(t *testing.T) {
+	d := newTestImage(t, FORMAT_D64)
+	err := d.WriteFile([]byte("BIG"), FILE_PRG, testData((d.BlocksFree()+1)*BLOCK_DATA))
+	if e, ok := err.(*DOSError); !ok || e.Code != DOS_DISK_FULL {
+		t.Errorf("got %v, expected DISK FULL", err)
+	}
+	err = d.WriteFile([]byte("FITS"), FILE_PRG, testData(d.BlocksFree()*BLOCK_DATA))
+	if err != nil {
+		t.Errorf("write to fill the disk: %s", err)
+	}
+	if d.BlocksFree() != 0 {
+		t.Errorf("got %d blocks free, expected 0", d.BlocksFree())
+	}
+}
+
+func Test_driveReplace(t *testing.T) {
+	d := newTestImage(t, FORMAT_D64)
+	drive := NewDrive(d)
+	old := testData(1000)
+	drive.SaveFile([]byte("PROG"), old)
+
+	// Replacing a file with one which only fits in the space of both keeps
+	// the old file
+	drive.SaveFile([]byte("@0:PROG"), testData((d.BlocksFree()+1)*BLOCK_DATA))
+	if msg := drive.statusMessage(); msg != "72,DISK FULL,00,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+	data, ok := drive.LoadFile([]byte("PROG"))
+	if !ok || !bytes.Equal(data, old) {
+		t.Errorf("old file was lost")
+	}
+
+	// A replacement which fits replaces it
+	replaced := testData(300)
+	drive.SaveFile([]byte("@0:PROG"), replaced)
+	if msg := drive.statusMessage(); msg != "00,OK,00,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+	data, ok = drive.LoadFile([]byte("PROG"))
+	if !ok || !bytes.Equal(data, replaced) {
+		t.Errorf("file was not replaced")
+	}
+	if n := len(files(t, d)); n != 1 {
+		t.Errorf("got %d files, expected 1", n)
+	}
+}
+
+func Test_driveReplaceHostDir(t *testing.T) {
+	h, err := OpenHostDir(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drive := NewDrive(h)
+	drive.SaveFile([]byte("PROG"), testData(1000))
+
+	// The replacement is the same host file as the file it replaces
+	replaced := testData(300)
+	drive.SaveFile([]byte("@0:PROG"), replaced)
+	if msg := drive.statusMessage(); msg != "00,OK,00,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+	data, ok := drive.LoadFile([]byte("PROG"))
+	if !ok || !bytes.Equal(data, replaced) {
+		t.Errorf("file was not replaced")
+	}
+	entries, err := h.Directory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, expected 1", len(entries))
+	}
+}
+
+func Test_driveDirectory(t *testing.T) {
+	d := newTestImage(t, FORMAT_D64)
+	drive := NewDrive(d)
+	drive.SaveFile([]byte("PROG"), testData(1000))
+
+	// A corrupt block count of more than four digits
+	e := files(t, d)[0]
+	b := d.dirEntry(e)
+	b[30], b[31] = 0xff, 0xff
+
+	data, err := drive.directory([]byte("*"))
+	if err != nil {
+		t.Fatalf("directory: %s", err)
+	}
+	if !bytes.Contains(data, []byte{0xff, 0xff, '"', 'P', 'R', 'O', 'G', '"'}) {
+		t.Errorf("directory doesn't list the file: % x", data)
+	}
+
+	drive.LoadFile([]byte("MISSING"))
+	if msg := drive.statusMessage(); msg != "62,FILE NOT FOUND,00,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func Test_gifWriter(t *testing.T) {
+	var palette color.Palette
+	for n := 0; n < 256; n++ {
+		palette = append(palette, color.RGBA{uint8(n), uint8(n), 0, 0xff})
+	}
+
+	// A full frame, then frames which only cover what has changed. The last
+	// is large enough to need several LZW blocks & a clear code.
+	frames := []*image.Paletted{
+		image.NewPaletted(image.Rect(0, 0, 320, 200), palette),
+		image.NewPaletted(image.Rect(8, 16, 24, 32), palette),
+		image.NewPaletted(image.Rect(0, 100, 320, 200), palette),
+	}
+	for n, frame := range frames {
+		for i := range frame.Pix {
+			frame.Pix[i] = uint8(i*(n+1) + i*i/7)
+		}
+	}
+	delays := []int{2, 0, 150}
+
+	var out bytes.Buffer
+	g, err := NewGIFWriter(&out, 320, 200, palette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, frame := range frames {
+		err = g.WriteFrame(frame, delays[n])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = g.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := gif.DecodeAll(&out)
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if decoded.Config.Width != 320 || decoded.Config.Height != 200 {
+		t.Errorf("got size %dx%d, expected 320x200", decoded.Config.Width, decoded.Config.Height)
+	}
+	if decoded.LoopCount != 0 {
+		t.Errorf("got loop count %d, expected 0 (forever)", decoded.LoopCount)
+	}
+	if len(decoded.Image) != len(frames) {
+		t.Fatalf("got %d frames, expected %d", len(decoded.Image), len(frames))
+	}
+	for n, frame := range frames {
+		got := decoded.Image[n]
+		if got.Rect != frame.Rect {
+			t.Errorf("frame %d: got %v, expected %v", n, got.Rect, frame.Rect)
+		}
+		if !bytes.Equal(got.Pix, frame.Pix) {
+			t.Errorf("frame %d: pixels differ", n)
+		}
+		if decoded.Delay[n] != delays[n] {
+			t.Errorf("frame %d: got delay %d, expected %d", n, decoded.Delay[n], delays[n])
+		}
+		if decoded.Disposal[n] != gif.DisposalNone {
+			t.Errorf("frame %d: got disposal %d, expected %d", n, decoded.Disposal[n], gif.DisposalNone)
+		}
+	}
+	if c := decoded.Image[0].Palette[200]; c != palette[200] {
+		t.Errorf("got colour %v, expected %v", c, palette[200])
+	}
+}
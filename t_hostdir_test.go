@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// newTestHostDir returns an empty host directory as a disk in a drive
+func newTestHostDir(t *testing.T, ascii bool) (*HostDir, *Drive) {
+	h, err := OpenHostDir(t.TempDir(), ascii)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, NewDrive(h)
+}
+
+// hostFiles returns the names of the files in a host directory
+func hostFiles(t *testing.T, h *HostDir) []string {
+	files, err := os.ReadDir(h.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Test_hostNames(t *testing.T) {
+	var tests = []struct {
+		name     string
+		fileType Byte
+		expected string
+	}{
+		{"HELLO", FILE_PRG, "hello.prg"},
+		{"DATA 1", FILE_SEQ, "data 1.seq"},
+		{"A/B:C", FILE_USR, "a%2Fb%3Ac.usr"},
+		{"\xc1BC", FILE_PRG, "Abc.prg"},
+		{"PI\xff", FILE_PRG, "pi%FF.prg"},
+	}
+
+	for _, test := range tests {
+		got := hostName([]byte(test.name), test.fileType)
+		if got != test.expected {
+			t.Errorf("%q: got %q, expected %q", test.name, got, test.expected)
+		}
+		back, ok := petsciiName(got[:len(got)-len(filepath.Ext(got))])
+		if !ok || !bytes.Equal(back, []byte(test.name)) {
+			t.Errorf("%q: got %q back", test.name, back)
+		}
+	}
+}
+
+func Test_hostDirWrite(t *testing.T) {
+	h, drive := newTestHostDir(t, false)
+	data := testData(1000)
+	drive.SaveFile([]byte("PROG"), data)
+	if msg := drive.statusMessage(); msg != "00,OK,00,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+	err := h.WriteFile([]byte("NOTES"), FILE_SEQ, []byte("HI\r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No temporary files are left behind
+	names := hostFiles(t, h)
+	if len(names) != 2 || names[0] != "notes.seq" || names[1] != "prog.prg" {
+		t.Errorf("got files %q", names)
+	}
+
+	entries, err := h.Directory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, expected 2", len(entries))
+	}
+	e := entries[1]
+	if string(e.Name) != "PROG" || e.Type != FILE_CLOSED|FILE_PRG || e.Blocks != 4 {
+		t.Errorf("got entry %q, type %#02x, %d blocks", e.Name, e.Type, e.Blocks)
+	}
+	got, ok := drive.LoadFile([]byte("PROG"))
+	if !ok || !bytes.Equal(got, data) {
+		t.Errorf("file read back differs")
+	}
+
+	// A file can't be written over
+	drive.SaveFile([]byte("PROG"), testData(10))
+	if msg := drive.statusMessage(); msg != "63,FILE EXISTS,00,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+}
+
+func Test_hostDirASCII(t *testing.T) {
+	h, _ := newTestHostDir(t, true)
+	err := h.WriteFile([]byte("NOTES"), FILE_SEQ, []byte("HELLO \xc1\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(h.Path, "notes.seq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello A\n" {
+		t.Errorf("got %q on the host", data)
+	}
+
+	// Programs are never converted
+	err = h.WriteFile([]byte("PROG"), FILE_PRG, []byte("HELLO\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := h.Directory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		data, err := h.ReadFile(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "HELLO \xc1\r"
+		if e.Type&FILE_TYPE == FILE_PRG {
+			expected = "HELLO\r\n"
+		}
+		if string(data) != expected {
+			t.Errorf("%s: got %q, expected %q", e.Name, data, expected)
+		}
+	}
+}
+
+func Test_hostDirReplace(t *testing.T) {
+	h, drive := newTestHostDir(t, false)
+
+	// Replacing a file of another type removes it
+	err := h.WriteFile([]byte("PROG"), FILE_SEQ, testData(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced := testData(300)
+	drive.SaveFile([]byte("@0:PROG"), replaced)
+	if msg := drive.statusMessage(); msg != "00,OK,00,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+	if names := hostFiles(t, h); len(names) != 1 || names[0] != "prog.prg" {
+		t.Errorf("got files %q, expected prog.prg", names)
+	}
+
+	// Replacing it with a file of the same type overwrites it
+	replaced = testData(50)
+	drive.SaveFile([]byte("@0:PROG"), replaced)
+	if names := hostFiles(t, h); len(names) != 1 || names[0] != "prog.prg" {
+		t.Errorf("got files %q, expected prog.prg", names)
+	}
+	data, ok := drive.LoadFile([]byte("PROG"))
+	if !ok || !bytes.Equal(data, replaced) {
+		t.Errorf("file was not replaced")
+	}
+}
+
+func Test_hostDirScratch(t *testing.T) {
+	h, drive := newTestHostDir(t, false)
+	for _, name := range []string{"PROG1", "PROG2", "OTHER"} {
+		drive.SaveFile([]byte(name), testData(10))
+	}
+
+	drive.command([]byte("S0:PROG*"))
+	if msg := drive.statusMessage(); msg != "01,FILES SCRATCHED,02,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+	if names := hostFiles(t, h); len(names) != 1 || names[0] != "other.prg" {
+		t.Errorf("got files %q, expected other.prg", names)
+	}
+
+	drive.command([]byte("S0:MISSING"))
+	if msg := drive.statusMessage(); msg != "01,FILES SCRATCHED,00,00\r" {
+		t.Errorf("status: got %q", msg)
+	}
+}
+
+func Test_hostDirRename(t *testing.T) {
+	h, drive := newTestHostDir(t, false)
+	data := testData(10)
+	drive.SaveFile([]byte("OLD"), data)
+	drive.SaveFile([]byte("TAKEN"), testData(20))
+
+	var tests = []struct {
+		command  string
+		expected string
+	}{
+		{"R0:NEW=OLD", "00,OK,00,00\r"},
+		{"R0:TAKEN=NEW", "63,FILE EXISTS,00,00\r"},
+		{"R0:OTHER=OLD", "62,FILE NOT FOUND,00,00\r"},
+	}
+	for _, test := range tests {
+		drive.command([]byte(test.command))
+		if msg := drive.statusMessage(); msg != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.command, msg, test.expected)
+		}
+	}
+
+	if names := hostFiles(t, h); len(names) != 2 || names[0] != "new.prg" || names[1] != "taken.prg" {
+		t.Errorf("got files %q, expected new.prg & taken.prg", names)
+	}
+	got, ok := drive.LoadFile([]byte("NEW"))
+	if !ok || !bytes.Equal(got, data) {
+		t.Errorf("renamed file differs")
+	}
+}
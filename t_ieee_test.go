@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testIEEEDevice logs the calls made to it, & sends the bytes in out
+type testIEEEDevice struct {
+	log []string
+	out []Byte
+}
+
+func (d *testIEEEDevice) Listen(secondary Byte) {
+	d.log = append(d.log, fmt.Sprintf("listen %02x", secondary))
+}
+
+func (d *testIEEEDevice) Unlisten() {
+	d.log = append(d.log, "unlisten")
+}
+
+func (d *testIEEEDevice) Talk(secondary Byte) {
+	d.log = append(d.log, fmt.Sprintf("talk %02x", secondary))
+}
+
+func (d *testIEEEDevice) Untalk() {
+	d.log = append(d.log, "untalk")
+}
+
+func (d *testIEEEDevice) Receive(data Byte, eoi bool) {
+	if eoi {
+		d.log = append(d.log, fmt.Sprintf("receive %02x eoi", data))
+	} else {
+		d.log = append(d.log, fmt.Sprintf("receive %02x", data))
+	}
+}
+
+func (d *testIEEEDevice) Send() (Byte, bool, bool) {
+	if len(d.out) == 0 {
+		return 0, false, false
+	}
+	data := d.out[0]
+	d.out = d.out[1:]
+	d.log = append(d.log, fmt.Sprintf("send %02x", data))
+	return data, len(d.out) == 0, true
+}
+
+// newTestIEEE returns a bus with a test device at address 8
+func newTestIEEE(t *testing.T) (*IEEEBus, *testIEEEDevice) {
+	b := &IEEEBus{}
+	d := &testIEEEDevice{}
+	err := b.Attach(8, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, d
+}
+
+// ieeeSend sends a byte from the PET, as the kernal does, & returns false if
+// no listener accepted it. With NRFD & NDAC both released there is no
+// listener.
+func ieeeSend(b *IEEEBus, data Byte, eoi bool) bool {
+	if b.NRFD() || !b.NDAC() {
+		return false
+	}
+	b.SetData(data)
+	b.SetEOI(eoi)
+	b.SetDAV(true)
+	accepted := !b.NDAC()
+	b.SetDAV(false)
+	b.SetEOI(false)
+	b.SetData(0)
+	return accepted
+}
+
+// ieeeCommand sends command bytes with ATN asserted, after releasing the
+// lines the PET drives as a listener
+func ieeeCommand(t *testing.T, b *IEEEBus, cmds ...Byte) {
+	b.SetNRFD(false)
+	b.SetNDAC(false)
+	b.SetATN(true)
+	for _, cmd := range cmds {
+		if !ieeeSend(b, cmd, false) {
+			t.Errorf("command %02x not accepted", cmd)
+		}
+	}
+	b.SetATN(false)
+}
+
+// ieeeReceive reads a byte from the talker, as the kernal does. ok is false
+// if the talker sends nothing.
+func ieeeReceive(b *IEEEBus) (data Byte, eoi bool, ok bool) {
+	b.SetNDAC(true)
+	b.SetNRFD(false)
+	for n := 0; n < 10 && !b.DAV(); n++ {
+		b.Tick(IEEE_TALK_DELAY / 4)
+	}
+	if !b.DAV() {
+		return 0, false, false
+	}
+	data, eoi = b.Data(), b.EOI()
+	b.SetNRFD(true)
+	b.SetNDAC(false)
+	b.SetNDAC(true)
+	return data, eoi, true
+}
+
+func Test_ieeeAttach(t *testing.T) {
+	b, _ := newTestIEEE(t)
+	for _, address := range []Byte{3, 31, 8} {
+		if err := b.Attach(address, &testIEEEDevice{}); err == nil {
+			t.Errorf("address %d: attached, expected an error", address)
+		}
+	}
+	if b.Device(8) == nil || b.Device(9) != nil {
+		t.Errorf("got the wrong devices")
+	}
+}
+
+func Test_ieeeListen(t *testing.T) {
+	var tests = []struct {
+		cmds     []Byte
+		expected string
+	}{
+		{[]Byte{IEEE_LISTEN | 8, IEEE_OPEN | 2}, "listen f2"},
+		{[]Byte{IEEE_LISTEN | 8, IEEE_DATA | 15}, "listen 6f"},
+		{[]Byte{IEEE_LISTEN | 8, IEEE_CLOSE | 1}, "listen e1"},
+		{[]Byte{IEEE_LISTEN | 8}, "listen 00"},
+
+		// Only the addressed device takes the secondary address
+		{[]Byte{IEEE_LISTEN | 9, IEEE_OPEN | 2, IEEE_LISTEN | 8}, "listen 00"},
+	}
+
+	for _, test := range tests {
+		b, d := newTestIEEE(t)
+		ieeeCommand(t, b, test.cmds...)
+		if !ieeeSend(b, 'A', false) || !ieeeSend(b, 'B', true) {
+			t.Errorf("% x: data not accepted", test.cmds)
+		}
+		ieeeCommand(t, b, IEEE_UNLISTEN)
+
+		expected := []string{test.expected, "receive 41", "receive 42 eoi", "unlisten"}
+		if !reflect.DeepEqual(d.log, expected) {
+			t.Errorf("% x: got %q, expected %q", test.cmds, d.log, expected)
+		}
+	}
+}
+
+func Test_ieeeNotPresent(t *testing.T) {
+	b, d := newTestIEEE(t)
+
+	// Every device accepts commands while ATN is asserted
+	b.SetATN(true)
+	if !b.NDAC() {
+		t.Errorf("ATN: NDAC released, expected devices to assert it")
+	}
+	b.SetATN(false)
+
+	// With nobody addressed the bus is released, which the kernal reports as
+	// DEVICE NOT PRESENT
+	ieeeCommand(t, b, IEEE_LISTEN|9, IEEE_OPEN)
+	if b.NDAC() || b.NRFD() {
+		t.Errorf("no listener: got NDAC %v, NRFD %v, expected both released", b.NDAC(), b.NRFD())
+	}
+	if ieeeSend(b, 'A', true) {
+		t.Errorf("no listener: data accepted")
+	}
+	if len(d.log) != 0 {
+		t.Errorf("got %q, expected no calls", d.log)
+	}
+}
+
+func Test_ieeeTalk(t *testing.T) {
+	b, d := newTestIEEE(t)
+	d.out = []Byte("HI")
+	ieeeCommand(t, b, IEEE_TALK|8, IEEE_DATA|0)
+
+	// The talker waits for the listeners to be ready for a while
+	b.SetNRFD(true)
+	b.SetNDAC(true)
+	b.Tick(IEEE_TALK_DELAY)
+	if b.DAV() {
+		t.Errorf("talker sent while NRFD was asserted")
+	}
+	b.SetNRFD(false)
+	b.Tick(IEEE_TALK_DELAY - 1)
+	if b.DAV() {
+		t.Errorf("talker sent after %d cycles", IEEE_TALK_DELAY-1)
+	}
+
+	var tests = []struct {
+		data Byte
+		eoi  bool
+		ok   bool
+	}{
+		{'H', false, true},
+		{'I', true, true},
+		{0, false, false},
+	}
+	for n, test := range tests {
+		data, eoi, ok := ieeeReceive(b)
+		if data != test.data || eoi != test.eoi || ok != test.ok {
+			t.Errorf("byte %d: got %02x, eoi %v, ok %v, expected %02x, eoi %v, ok %v", n, data, eoi, ok, test.data, test.eoi, test.ok)
+		}
+	}
+	ieeeCommand(t, b, IEEE_UNTALK)
+
+	expected := []string{"talk 60", "send 48", "send 49", "untalk"}
+	if !reflect.DeepEqual(d.log, expected) {
+		t.Errorf("got %q, expected %q", d.log, expected)
+	}
+	if b.DAV() || b.NDAC() {
+		t.Errorf("after untalk: got DAV %v, NDAC %v, expected the bus released", b.DAV(), b.NDAC())
+	}
+}
+
+func Test_ieeeHeld(t *testing.T) {
+	var tests = []struct {
+		secondary Byte
+		expected  Byte
+	}{
+		{IEEE_DATA | 2, 'A'}, // The same channel is sent the held byte
+		{IEEE_DATA | 3, 'B'}, // Another channel isn't
+	}
+
+	for _, test := range tests {
+		b, d := newTestIEEE(t)
+		d.out = []Byte("AB")
+		ieeeCommand(t, b, IEEE_TALK|8, IEEE_DATA|2)
+
+		// ATN interrupts the talker before the byte is accepted
+		b.SetNDAC(true)
+		b.SetNRFD(false)
+		b.Tick(IEEE_TALK_DELAY)
+		if !b.DAV() {
+			t.Fatalf("talker didn't send")
+		}
+		b.SetATN(true)
+		ieeeCommand(t, b, IEEE_UNTALK, IEEE_TALK|8, test.secondary)
+
+		data, _, ok := ieeeReceive(b)
+		if !ok || data != test.expected {
+			t.Errorf("secondary %02x: got %02x, expected %02x", test.secondary, data, test.expected)
+		}
+	}
+}
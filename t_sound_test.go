@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sampleSink keeps the samples written to it
+type sampleSink struct {
+	samples []int16
+}
+
+func (s *sampleSink) WriteSamples(samples []int16) error {
+	s.samples = append(s.samples, samples...)
+	return nil
+}
+
+// playShift runs the VIA shift register free-running with the given timer 2
+// latch & pattern, for a number of cycles, & returns the sound it makes
+func playShift(latch, pattern Byte, cycles int, sinks ...AudioSink) *Sound {
+	via := &VIA{Base: 0xe840}
+	via.Reset()
+	via.Write(0xe840+0x8, latch)
+	via.Write(0xe840+0xb, VIA_SR_OUT_FREE<<2)
+	via.Write(0xe840+0xa, pattern)
+
+	sound := &Sound{CB2: via.CB2, Sinks: sinks}
+	for n := 0; n < cycles; n++ {
+		via.Tick(1)
+		sound.Tick(1)
+	}
+	sound.Flush()
+	return sound
+}
+
+func Test_soundShiftRegister(t *testing.T) {
+	var tests = []struct {
+		latch Byte
+	}{
+		{0x1e},
+		{0x3e},
+		{0x7e},
+	}
+
+	for _, test := range tests {
+		sink := &sampleSink{}
+		playShift(test.latch, 0x0f, CPU_CLOCK, sink)
+
+		if len(sink.samples) != SAMPLE_RATE {
+			t.Errorf("latch %#02x: got %d samples in a second, expected %d", test.latch, len(sink.samples), SAMPLE_RATE)
+		}
+
+		// Count the rising zero crossings & the peak level, once the filter
+		// has settled
+		crossings, peak := 0, 0
+		settled := sink.samples[SAMPLE_RATE/2:]
+		for n := 1; n < len(settled); n++ {
+			if settled[n-1] < 0 && settled[n] >= 0 {
+				crossings++
+			}
+			level := int(settled[n])
+			if level < 0 {
+				level = -level
+			}
+			if level > peak {
+				peak = level
+			}
+		}
+
+		// A bit is shifted every 2(N+2) cycles, & the pattern is 8 bits long
+		expected := CPU_CLOCK / (16 * (int(test.latch) + 2)) / 2
+		if crossings < expected-1 || crossings > expected+1 {
+			t.Errorf("latch %#02x: got %d cycles of the square wave in half a second, expected %d", test.latch, crossings, expected)
+		}
+		// The filter droops over each half of the wave, so the edges
+		// overshoot a little more as the pitch falls
+		if peak < soundLevel*9/10 || peak > soundLevel*5/4 {
+			t.Errorf("latch %#02x: got peak level %d, expected about %d", test.latch, peak, soundLevel)
+		}
+	}
+}
+
+func Test_soundSilent(t *testing.T) {
+	// With the shift register disabled CB2 stays high, which the filter
+	// removes
+	sink := &sampleSink{}
+	via := &VIA{Base: 0xe840}
+	via.Reset()
+	sound := &Sound{CB2: via.CB2, Sinks: []AudioSink{sink}}
+	for n := 0; n < CPU_CLOCK/10; n++ {
+		via.Tick(1)
+		sound.Tick(1)
+	}
+	sound.Flush()
+
+	for n, s := range sink.samples[len(sink.samples)/2:] {
+		if s < -1 || s > 1 {
+			t.Fatalf("got sample %d = %d, expected silence", n, s)
+		}
+	}
+}
+
+func Test_wavFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.wav")
+	wav, err := CreateWAV(filename, SAMPLE_RATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &sampleSink{}
+	playShift(0x1e, 0x0f, CPU_CLOCK/10, wav, sink)
+	err = wav.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(sink.samples) * 2
+	if len(data) != wavHeaderSize+size {
+		t.Fatalf("got %d bytes, expected %d", len(data), wavHeaderSize+size)
+	}
+
+	var tests = []struct {
+		name     string
+		offset   int
+		length   int
+		expected uint32
+	}{
+		{"RIFF size", 4, 4, uint32(36 + size)},
+		{"fmt size", 16, 4, 16},
+		{"format", 20, 2, wavFormatPCM},
+		{"channels", 22, 2, 1},
+		{"sample rate", 24, 4, SAMPLE_RATE},
+		{"byte rate", 28, 4, SAMPLE_RATE * 2},
+		{"block align", 32, 2, 2},
+		{"bits per sample", 34, 2, 16},
+		{"data size", 40, 4, uint32(size)},
+	}
+	for _, id := range []struct {
+		offset int
+		text   string
+	}{{0, "RIFF"}, {8, "WAVE"}, {12, "fmt "}, {36, "data"}} {
+		if got := string(data[id.offset : id.offset+4]); got != id.text {
+			t.Errorf("got %q at %d, expected %q", got, id.offset, id.text)
+		}
+	}
+	for _, test := range tests {
+		var got uint32
+		if test.length == 2 {
+			got = uint32(binary.LittleEndian.Uint16(data[test.offset:]))
+		} else {
+			got = binary.LittleEndian.Uint32(data[test.offset:])
+		}
+		if got != test.expected {
+			t.Errorf("%s: got %d, expected %d", test.name, got, test.expected)
+		}
+	}
+
+	// The samples follow the header, as written to the other sink
+	for n, s := range sink.samples {
+		got := int16(binary.LittleEndian.Uint16(data[wavHeaderSize+n*2:]))
+		if got != s {
+			t.Fatalf("sample %d: got %d, expected %d", n, got, s)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testT64 returns an archive holding a file for each entry, with the given
+// start & end addresses & data size
+func testT64(entries ...[3]int) []byte {
+	data := make([]byte, T64_HEADER_SIZE+len(entries)*T64_ENTRY_SIZE)
+	copy(data, "C64S tape file")
+	binary.LittleEndian.PutUint16(data[T64_MAX_ENTRIES:], uint16(len(entries)))
+	binary.LittleEndian.PutUint16(data[T64_USED:], uint16(len(entries)))
+	for n, e := range entries {
+		entry := data[T64_HEADER_SIZE+n*T64_ENTRY_SIZE:]
+		entry[0], entry[1] = T64_TAPE, FILE_CLOSED|FILE_PRG
+		binary.LittleEndian.PutUint16(entry[2:], uint16(e[0]))
+		binary.LittleEndian.PutUint16(entry[4:], uint16(e[1]))
+		binary.LittleEndian.PutUint32(entry[8:], uint32(len(data)))
+		copy(entry[16:32], "FILE            ")
+		data = append(data, testData(e[2])...)
+	}
+	return data
+}
+
+func Test_t64Sizes(t *testing.T) {
+	var tests = []struct {
+		start, end, size int
+		expected         int
+	}{
+		{0x0401, 0x0801, 0x400, 0x400},
+		{0x0401, 0x0000, 0x400, 0x400},  // End missing
+		{0x0401, 0x2001, 0x400, 0x400},  // End past the data
+		{0x0801, 0x0401, 0x400, 0x400},  // End before the start
+		{0xf000, 0x0000, 0x2000, 0xfff}, // Data past the top of memory
+		{0xffff, 0x0000, 0x10, 0},
+	}
+
+	for _, test := range tests {
+		a, err := ParseT64(testT64([3]int{test.start, test.end, test.size}))
+		if err != nil {
+			t.Errorf("$%04x-$%04x: %s", test.start, test.end, err)
+			continue
+		}
+		e := a.Entries[0]
+		if e.Size() != test.expected {
+			t.Errorf("$%04x-$%04x: got size %d, expected %d", test.start, test.end, e.Size(), test.expected)
+		}
+		if prg := a.PRG(e); len(prg) != 2+test.expected {
+			t.Errorf("$%04x-$%04x: got PRG of %d bytes, expected %d", test.start, test.end, len(prg), 2+test.expected)
+		}
+	}
+
+	// Each file is limited to the data before the next
+	a, err := ParseT64(testT64([3]int{0x0401, 0x0000, 0x100}, [3]int{0x0401, 0x0501, 0x100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, e := range a.Entries {
+		if e.Size() != 0x100 {
+			t.Errorf("file %d: got size %d, expected %d", n, e.Size(), 0x100)
+		}
+	}
+}
+
+func Test_t64Choose(t *testing.T) {
+	data := testT64([3]int{0x0401, 0x0501, 0x100}, [3]int{0x0401, 0x0601, 0x200})
+	a, err := ParseT64(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		choose   func([]string) (int, error)
+		expected int
+	}{
+		{"no chooser", nil, 0},
+		{"chooser", func(names []string) (int, error) { return 1, nil }, 1},
+	}
+	for _, test := range tests {
+		c := &Cassette{Choose: test.choose}
+		prg, err := c.loadT64(data, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if expected := a.PRG(a.Entries[test.expected]); !bytes.Equal(prg, expected) {
+			t.Errorf("%s: got %d bytes, expected file %d", test.name, len(prg), test.expected)
+		}
+	}
+}
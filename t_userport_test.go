@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeScript writes a joystick script to a temporary file
+func writeScript(t *testing.T, script string) string {
+	filename := filepath.Join(t.TempDir(), "joystick.txt")
+	err := os.WriteFile(filename, []byte(script), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func Test_joystickLines(t *testing.T) {
+	var tests = []struct {
+		joy1, joy2 Byte
+		expected   Byte
+	}{
+		{0, 0, 0xff},
+		{JOY_UP, 0, 0xfe},
+		{JOY_DOWN, 0, 0xfd},
+		{JOY_LEFT, 0, 0xfb},
+		{JOY_RIGHT, 0, 0xf7},
+		{0, JOY_UP, 0xef},
+		{0, JOY_RIGHT, 0x7f},
+		{JOY_UP | JOY_LEFT, JOY_DOWN | JOY_RIGHT, 0x5a},
+
+		// Fire closes left & right together
+		{JOY_FIRE, 0, 0xf3},
+		{0, JOY_FIRE, 0x3f},
+		{JOY_UP | JOY_FIRE, JOY_DOWN | JOY_FIRE, 0x12},
+	}
+
+	for _, test := range tests {
+		joy := &UserPortJoystick{}
+		joy.Set(0, test.joy1)
+		joy.Set(1, test.joy2)
+		if got := joy.Read(); got != test.expected {
+			t.Errorf("joysticks %#02x & %#02x: got lines %#02x, expected %#02x", test.joy1, test.joy2, got, test.expected)
+		}
+	}
+
+	// Lines are open collector, so the PET can also pull them low
+	joy := &UserPortJoystick{}
+	joy.Set(0, JOY_UP)
+	port := &UserPort{Device: joy}
+	port.Write(0x7f)
+	if got := port.Read(); got != 0x7e {
+		t.Errorf("got user port lines %#02x, expected 0x7e", got)
+	}
+}
+
+func Test_joystickScript(t *testing.T) {
+	filename := writeScript(t, `# Walk right, then jump
+2s    1 right
+
+2.5s  1 right+fire
+2.5s  2 up
+3s    1 none
+`)
+	script, err := LoadJoystickScript(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		cycle    uint64
+		expected Byte
+	}{
+		{0, 0xff},
+		{1999999, 0xff},
+		{2000000, 0xf7},
+		{2499999, 0xf7},
+		{2500000, 0xe3},
+		{2999999, 0xe3},
+		{3000000, 0xef},
+		{10000000, 0xef},
+	}
+	joy := &UserPortJoystick{}
+	for _, test := range tests {
+		script.Play(test.cycle, joy)
+		if got := joy.Read(); got != test.expected {
+			t.Errorf("cycle %d: got lines %#02x, expected %#02x", test.cycle, got, test.expected)
+		}
+	}
+}
+
+func Test_joystickScriptErrors(t *testing.T) {
+	var tests = []struct {
+		script   string
+		expected string
+	}{
+		{"1s 1", ":1: expected time, joystick & inputs"},
+		{"1s 1 up down", ":1: expected time, joystick & inputs"},
+		{"# comment\nsoon 1 up", ":2: time: invalid duration"},
+		{"1s 0 up", `:1: invalid joystick "0"`},
+		{"1s 3 up", `:1: invalid joystick "3"`},
+		{"1s x up", `:1: invalid joystick "x"`},
+		{"1s 1 jump", `:1: unknown joystick input "jump"`},
+		{"1s 1 up+", `:1: unknown joystick input ""`},
+		{"2s 1 up\n1s 1 down", ":2: events must be in time order"},
+	}
+
+	for _, test := range tests {
+		_, err := LoadJoystickScript(writeScript(t, test.script))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%q: got error %v, expected %q", test.script, err, test.expected)
+		}
+	}
+
+	_, err := LoadJoystickScript(filepath.Join(t.TempDir(), "missing.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("missing script: got error %v, expected it not to exist", err)
+	}
+}
+
+// newTestUserPort returns a VIA with a device on its user port, made by
+// device with the VIA's CA1
+func newTestUserPort(device func(ca1 func(level bool)) UserPortDevice) (*VIA, *UserPort) {
+	port := &UserPort{}
+	via := &VIA{
+		Base: 0xe840,
+		PortRead: func(p int) Byte {
+			if p == VIA_PORTA {
+				return port.Read()
+			}
+			return 0xff
+		},
+		PortWrite: func(p int, data Byte) {
+			if p == VIA_PORTA {
+				port.Write(data)
+			}
+		},
+	}
+	port.VIA = via
+	port.Device = device(via.CA1)
+	via.Reset()
+	port.Reset()
+	return via, port
+}
+
+func Test_userPortLoopback(t *testing.T) {
+	via, port := newTestUserPort(func(ca1 func(level bool)) UserPortDevice {
+		return &UserPortLoopback{CA1: ca1}
+	})
+
+	// Each half of port A reads back what is written to the other half
+	var tests = []struct {
+		dir, data Byte
+		expected  Byte
+	}{
+		{0x0f, 0x05, 0x55},
+		{0x0f, 0x0a, 0xaa},
+		{0x0f, 0x00, 0x00},
+		{0xf0, 0x30, 0x33},
+		{0xf0, 0xc0, 0xcc},
+		{0x00, 0x00, 0xff},
+	}
+	for _, test := range tests {
+		via.Write(0xe840+0x3, test.dir)
+		via.Write(0xe840+0xf, test.data)
+		if got := via.Read(0xe840 + 0xf); got != test.expected {
+			t.Errorf("direction %#02x, wrote %#02x: got %#02x, expected %#02x", test.dir, test.data, got, test.expected)
+		}
+	}
+
+	// Taking CB2 low gives a falling edge on CA1
+	if via.Read(0xe840+0xd)&VIA_IRQ_CA1 != 0 {
+		t.Fatalf("CA1 interrupt flag set before CB2 changed")
+	}
+	via.Write(0xe840+0xc, VIA_C2_LOW<<5)
+	port.Tick(1)
+	if via.Read(0xe840+0xd)&VIA_IRQ_CA1 == 0 {
+		t.Errorf("CB2 low: CA1 interrupt flag not set")
+	}
+
+	// With CA1 set for a rising edge, taking CB2 high again sets it too
+	via.Read(0xe840 + 0x1)
+	via.Write(0xe840+0xc, VIA_C2_HIGH<<5|0x01)
+	port.Tick(1)
+	if via.Read(0xe840+0xd)&VIA_IRQ_CA1 == 0 {
+		t.Errorf("CB2 high: CA1 interrupt flag not set")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newTestVIA returns a reset VIA, with port B read from pb
+func newTestVIA(pb *Byte) *VIA {
+	v := &VIA{
+		Base: 0xe840,
+		PortRead: func(port int) Byte {
+			if port == VIA_PORTB && pb != nil {
+				return *pb
+			}
+			return 0xff
+		},
+	}
+	v.Reset()
+	return v
+}
+
+// runTimer1 runs the VIA a cycle at a time, & returns the cycles at which
+// timer 1 interrupted & PB7 changed
+func runTimer1(v *VIA, cycles int) (irqs []int, pb7 []int) {
+	last := v.Read(0xe840+0x0) & 0x80
+	for n := 1; n <= cycles; n++ {
+		v.Tick(1)
+		if v.Read(0xe840+0xd)&VIA_IRQ_T1 != 0 {
+			irqs = append(irqs, n)
+			v.Read(0xe840 + 0x4) // Clears the flag
+		}
+		if b := v.Read(0xe840+0x0) & 0x80; b != last {
+			pb7 = append(pb7, n)
+			last = b
+		}
+	}
+	return irqs, pb7
+}
+
+func Test_viaTimer1(t *testing.T) {
+	var tests = []struct {
+		name string
+		aux  Byte
+		irqs []int
+		pb7  []int
+	}{
+		{"one-shot", 0x00, []int{11}, nil},
+		{"one-shot PB7", VIA_ACR_T1_PB7, []int{11}, []int{11}},
+		{"free-run", VIA_ACR_T1_FREE, []int{11, 23, 35, 47, 59}, nil},
+		{"free-run PB7", VIA_ACR_T1_FREE | VIA_ACR_T1_PB7, []int{11, 23, 35, 47, 59}, []int{11, 23, 35, 47, 59}},
+	}
+
+	for _, test := range tests {
+		v := newTestVIA(nil)
+		v.Write(0xe840+0xb, test.aux)
+		v.Write(0xe840+0x4, 10)
+		v.Write(0xe840+0x5, 0)
+
+		// Starting the timer takes PB7 low
+		if test.aux&VIA_ACR_T1_PB7 != 0 && v.Read(0xe840+0x0)&0x80 != 0 {
+			t.Errorf("%s: PB7 high after the timer started", test.name)
+		}
+		irqs, pb7 := runTimer1(v, 60)
+		if !reflect.DeepEqual(irqs, test.irqs) {
+			t.Errorf("%s: got interrupts at %v, expected %v", test.name, irqs, test.irqs)
+		}
+		if !reflect.DeepEqual(pb7, test.pb7) {
+			t.Errorf("%s: got PB7 changes at %v, expected %v", test.name, pb7, test.pb7)
+		}
+	}
+
+	// Writing the latches doesn't restart the timer
+	v := newTestVIA(nil)
+	v.Write(0xe840+0x4, 10)
+	v.Write(0xe840+0x5, 0)
+	v.Tick(5)
+	v.Write(0xe840+0x6, 100)
+	v.Write(0xe840+0x7, 0)
+	if irqs, _ := runTimer1(v, 10); !reflect.DeepEqual(irqs, []int{6}) {
+		t.Errorf("latch written: got interrupts at %v, expected [6]", irqs)
+	}
+}
+
+func Test_viaTimer2(t *testing.T) {
+	// One-shot: the counter keeps running, but only interrupts once
+	v := newTestVIA(nil)
+	v.Write(0xe840+0x8, 10)
+	v.Write(0xe840+0x9, 0)
+	var irqs []int
+	for n := 1; n <= 0x10100; n++ {
+		v.Tick(1)
+		if v.Read(0xe840+0xd)&VIA_IRQ_T2 != 0 {
+			irqs = append(irqs, n)
+			v.Read(0xe840 + 0x8)
+		}
+	}
+	if !reflect.DeepEqual(irqs, []int{11}) {
+		t.Errorf("one-shot: got interrupts at %v, expected [11]", irqs)
+	}
+
+	// Pulse counting: falling edges on PB6 count down
+	pb := Byte(0xff)
+	v = newTestVIA(&pb)
+	v.Write(0xe840+0xb, VIA_ACR_T2_COUNT)
+	v.Write(0xe840+0x8, 3)
+	v.Write(0xe840+0x9, 0)
+	v.Tick(100)
+	if v.Read(0xe840+0x8) != 3 {
+		t.Errorf("pulse count: counted without pulses")
+	}
+	for n := 1; n <= 4; n++ {
+		pb = 0xbf
+		v.Tick(2)
+		pb = 0xff
+		v.Tick(2)
+		irq := v.Read(0xe840+0xd)&VIA_IRQ_T2 != 0
+		if irq != (n == 4) {
+			t.Errorf("pulse count: after %d pulses got interrupt %v", n, irq)
+		}
+	}
+}
+
+func Test_viaInterrupts(t *testing.T) {
+	var tests = []struct {
+		name    string
+		ier     []Byte // Values written to the IER
+		enabled Byte   // IER read back
+		irq     bool
+	}{
+		{"disabled", nil, 0x80, false},
+		{"enabled", []Byte{0x80 | VIA_IRQ_T1}, 0x80 | VIA_IRQ_T1, true},
+		{"other enabled", []Byte{0x80 | VIA_IRQ_T2 | VIA_IRQ_CA1}, 0x80 | VIA_IRQ_T2 | VIA_IRQ_CA1, false},
+		{"cleared", []Byte{0xff, VIA_IRQ_T1}, 0xff &^ VIA_IRQ_T1, false},
+		{"set again", []Byte{0xff, 0x7f, 0x80 | VIA_IRQ_T1}, 0x80 | VIA_IRQ_T1, true},
+	}
+
+	for _, test := range tests {
+		v := newTestVIA(nil)
+		for _, ier := range test.ier {
+			v.Write(0xe840+0xe, ier)
+		}
+		v.Write(0xe840+0x4, 0)
+		v.Write(0xe840+0x5, 0)
+		v.Tick(2)
+
+		if got := v.Read(0xe840 + 0xe); got != test.enabled {
+			t.Errorf("%s: got IER %#02x, expected %#02x", test.name, got, test.enabled)
+		}
+		if got := v.CheckInterrupt(); got != test.irq {
+			t.Errorf("%s: got interrupt %v, expected %v", test.name, got, test.irq)
+		}
+		expected := Byte(VIA_IRQ_T1)
+		if test.irq {
+			expected |= VIA_IRQ_ANY
+		}
+		if got := v.Read(0xe840 + 0xd); got != expected {
+			t.Errorf("%s: got IFR %#02x, expected %#02x", test.name, got, expected)
+		}
+
+		// Writing a 1 to a flag clears it
+		v.Write(0xe840+0xd, VIA_IRQ_T1)
+		if v.Read(0xe840+0xd) != 0 || v.CheckInterrupt() {
+			t.Errorf("%s: flag not cleared", test.name)
+		}
+	}
+}
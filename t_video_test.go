@@ -0,0 +1,69 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+// Frames drawn by Test_frameBuffer
+const testFrames = 1000
+
+// Test_frameBuffer passes frames from a goroutine filling them to one drawing
+// them, as the video & GUI do. Run it with -race to check that a frame is never
+// used by both at once.
+func Test_frameBuffer(t *testing.T) {
+	b := NewFrameBuffer()
+	if f := b.Front(); f != nil {
+		t.Fatalf("got a front frame before any were published")
+	}
+
+	// The video fills frames until the GUI has drawn enough of them
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for n := uint64(1); ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			f := b.Back()
+			if f == nil {
+				t.Errorf("frame %d: got no back frame", n)
+				return
+			}
+
+			// Every byte of the screen is the frame number, so a frame which
+			// is changed while it is drawn is seen
+			src := Frame{Number: n, Screen: make([]Byte, 1000)}
+			for i := range src.Screen {
+				src.Screen[i] = Byte(n)
+			}
+			src.CopyTo(f)
+			b.Publish(f)
+			runtime.Gosched()
+		}
+	}()
+
+	last := uint64(0)
+	for drawn := 0; drawn < testFrames; {
+		f := b.Front()
+		if f == nil || f.Number == last {
+			runtime.Gosched()
+			continue
+		}
+		if f.Number < last {
+			t.Fatalf("got frame %d after frame %d", f.Number, last)
+		}
+		last = f.Number
+		drawn++
+		for i, c := range f.Screen {
+			if c != Byte(last) {
+				t.Fatalf("frame %d: got %#02x at %d, expected %#02x", last, c, i, Byte(last))
+			}
+		}
+	}
+	close(stop)
+	<-done
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 const DATA_START = 2
@@ -64,27 +69,99 @@ func (p *Prg) Save(data []Byte) []byte {
 	return prg
 }
 
+/*
+Cassette loads & saves whole programs for the LOAD & SAVE traps. A program is
+read from a PRG file, or from a T64 archive, where the file is chosen by the
+name typed in BASIC. If no name was typed & the archive holds more than one
+file, Choose is called to pick one, or without Choose the first is loaded.
+
+If Dir is set, files are found in the directory by name, as a tape would find
+them, rather than being chosen by the user.
+*/
 type Cassette struct {
+	Dir    string                            // Directory of PRG & T64 files
+	Choose func(names []string) (int, error) // Choose a file from an archive
+
 	filename string
 	prg      *Prg
-	cb       Word
 }
 
-func (c *Cassette) Load(filename string) error {
+// Find returns the first PRG file in Dir whose name starts with the given
+// name, or the first T64 archive which holds such a file
+func (c *Cassette) Find(name []byte) (string, error) {
+	files, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return "", err
+	}
+	pattern := append(append([]byte{}, name...), '*')
+	for _, file := range files {
+		path := filepath.Join(c.Dir, file.Name())
+		ext := filepath.Ext(file.Name())
+		switch strings.ToLower(ext) {
+		case ".prg":
+			n, ok := petsciiName(strings.TrimSuffix(file.Name(), ext))
+			if ok && matchName(pattern, n) {
+				return path, nil
+			}
+		case ".t64":
+			t, err := OpenT64(path)
+			if err == nil && t.Find(name) != nil {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%q: %w", petsciiToASCIIString(name), fs.ErrNotExist)
+}
+
+// Load reads a PRG file, or the file with the given name from a T64 archive
+func (c *Cassette) Load(filename string, name []byte) error {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
+	if IsT64(data) {
+		data, err = c.loadT64(data, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	if len(data) < DATA_START {
+		return fmt.Errorf("%s: no load address", filename)
+	}
 	prg := &Prg{}
 	prg.Load(data)
 
 	c.filename = filename
 	c.prg = prg
-	c.cb = 0
 
 	return nil
 }
 
+// loadT64 returns a file from a T64 archive as a PRG
+func (c *Cassette) loadT64(data []byte, name []byte) ([]byte, error) {
+	t, err := ParseT64(data)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := t.Find(name)
+	if len(name) == 0 && len(t.Entries) > 1 && c.Dir == "" && c.Choose != nil {
+		names := make([]string, len(t.Entries))
+		for n, e := range t.Entries {
+			names[n] = petsciiToASCIIString(e.Name)
+		}
+		n, err := c.Choose(names)
+		if err != nil {
+			return nil, err
+		}
+		entry = t.Entries[n]
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("%q: %w", petsciiToASCIIString(name), fs.ErrNotExist)
+	}
+	return t.PRG(entry), nil
+}
+
 func (c *Cassette) Addr() Word {
 	return c.prg.Addr()
 }
@@ -93,13 +170,22 @@ func (c *Cassette) Size() Word {
 	return c.prg.Size()
 }
 
-func (c *Cassette) FetchByte() Byte {
-	b := c.prg.Read(c.cb)
-	c.cb++
-	return b
+// Program returns the program which was loaded
+func (c *Cassette) Program() *Prg {
+	return c.prg
 }
 
+// Save writes size bytes of data, saved from the given address, as a PRG file
 func (c *Cassette) Save(filename string, address Word, size Word, data []Byte) error {
+	switch {
+	case size == 0:
+		return errors.New("nothing to save")
+	case int(address)+int(size) > 0x10000:
+		return fmt.Errorf("$%04x+%d is past the end of memory", address, size)
+	case len(data) < int(size):
+		return fmt.Errorf("%d bytes of data for a %d byte program", len(data), size)
+	}
+
 	prg := Prg{}
 	prg.SetAddr(address)
 	prg.SetSize(size)
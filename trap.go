@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sqweek/dialog"
+)
+
+// Device numbers of the cassette drives
+const (
+	DEVICE_TAPE1 = 1
+	DEVICE_TAPE2 = 2
+)
+
+// Offsets of the kernal error messages, returned by the traps
+const (
+	KERNAL_OK                 = 0x00
+	KERNAL_FILE_NOT_FOUND     = 0x24
+	KERNAL_DEVICE_NOT_PRESENT = 0x74
+	KERNAL_NOT_OUTPUT_FILE    = 0x94
+)
+
+// Status bit set when VERIFY finds a difference
+const STATUS_VERIFY = 0x10
+
+/*
+HandleTrap performs LOAD, VERIFY & SAVE for the kernal patches, using the
+filename, device number & secondary address set by the kernal. Programs on the
+cassette devices are host PRG files or T64 archives, & programs on IEEE-488
+devices are read from & written to the emulated drives. The result is returned
+to the patch in A.
+*/
+func (p *PET) HandleTrap(selector Byte) {
+	var result Byte
+	switch selector {
+	case TRAP_LOAD:
+		result = p.trapLoad()
+	case TRAP_SAVE:
+		result = p.trapSave()
+	}
+	p.cpu.Registers.A.Set(result)
+}
+
+// filename returns the filename given to LOAD or SAVE
+func (p *PET) filename() []byte {
+	length := p.bus.Read(FNLEN)
+	addr := p.ReadWord(FNADR)
+	name := make([]byte, length)
+	for n := range name {
+		name[n] = byte(p.bus.Read(addr + Word(n)))
+	}
+	return name
+}
+
+// drive returns the drive at an IEEE-488 address, or nil
+func (p *PET) drive(device Byte) *Drive {
+	drive, _ := p.ieee.Device(device).(*Drive)
+	return drive
+}
+
+// tapeFile returns the host file for a LOAD or SAVE on a cassette device.
+// Files are found in the cassette directory, or chosen with a dialog.
+func (p *PET) tapeFile(name []byte, save bool) (string, error) {
+	switch {
+	case p.cassette.Dir == "":
+	case !save:
+		return p.cassette.Find(name)
+	case len(name) > 0:
+		return filepath.Join(p.cassette.Dir, hostName(name, FILE_PRG)), nil
+	}
+
+	if p.gui == nil {
+		return "", errors.New("no file can be chosen without a window; use -prgdir")
+	}
+
+	if save {
+		return p.gui.SaveDialog("Save program", "PRG files", "prg")
+	}
+	return p.gui.LoadDialog("Load program", "PRG & T64 files", "prg", "t64")
+}
+
+// trapLoad loads or verifies a program
+func (p *PET) trapLoad() Byte {
+	name := p.filename()
+	device := p.bus.Read(FA)
+
+	var prg *Prg
+	switch {
+	case device == DEVICE_TAPE1 || device == DEVICE_TAPE2:
+		filename, err := p.tapeFile(name, false)
+		if err == nil {
+			err = p.cassette.Load(filename, name)
+		}
+		if errors.Is(err, dialog.Cancelled) {
+			return KERNAL_OK
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "load: %s\n", err)
+			return KERNAL_FILE_NOT_FOUND
+		}
+		prg = p.cassette.Program()
+	case p.drive(device) != nil:
+		data, ok := p.drive(device).LoadFile(name)
+		if !ok || len(data) < DATA_START {
+			return KERNAL_FILE_NOT_FOUND
+		}
+		prg = &Prg{}
+		prg.Load(data)
+	default:
+		return KERNAL_DEVICE_NOT_PRESENT
+	}
+
+	// Secondary address 0 loads a program at the start of BASIC, & any other
+	// at the address it was saved from
+	addr := prg.Addr()
+	if p.bus.Read(SA) == 0 {
+		addr = p.ReadWord(TXTTAB)
+	}
+	size := prg.Size()
+
+	if p.bus.Read(VERCK) != 0 {
+		fmt.Fprintf(os.Stderr, "verify %d bytes at address $%04x\n", size, addr)
+		for n := Word(0); n < size; n++ {
+			if p.bus.Read(addr+n) != prg.Read(n) {
+				p.bus.Write(STATUS, p.bus.Read(STATUS)|STATUS_VERIFY)
+				break
+			}
+		}
+		return KERNAL_OK
+	}
+
+	fmt.Fprintf(os.Stderr, "load %d bytes to address $%04x\n", size, addr)
+	for n := Word(0); n < size; n++ {
+		p.bus.Write(addr+n, prg.Read(n))
+	}
+	if addr == p.ReadWord(TXTTAB) {
+		p.relink(addr, addr+size)
+	}
+	// Set top of BASIC
+	p.WriteWord(VARTAB, addr+size)
+	return KERNAL_OK
+}
+
+// relink rebuilds the links between the lines of a BASIC program, as BASIC
+// does after a LOAD. The links are wrong if the program was saved from a
+// different address, & drives send dummy links in a directory listing.
+func (p *PET) relink(addr, end Word) {
+	for addr+1 < end && p.ReadWord(addr) != 0 {
+		// Each line is a link, a line number & text ending with 0
+		next := addr + 4
+		for next < end && p.bus.Read(next) != 0 {
+			next++
+		}
+		next++
+		p.WriteWord(addr, next)
+		addr = next
+	}
+}
+
+/*
+trapSave saves memory from the start address up to, but not including, the end
+address. SAVE from BASIC sets these to the BASIC program, & the monitor's .S
+command sets them to the range given E.g. .S "NAME",01,7000,7100 saves $7000
+to $70FF. An empty range, or one which ends before it starts, is an error.
+*/
+func (p *PET) trapSave() Byte {
+	name := p.filename()
+	device := p.bus.Read(FA)
+
+	start := p.ReadWord(STAL)
+	end := p.ReadWord(EAL)
+	if end <= start {
+		fmt.Fprintf(os.Stderr, "save: invalid range $%04x-$%04x\n", start, end)
+		return KERNAL_NOT_OUTPUT_FILE
+	}
+	size := end - start
+
+	fmt.Fprintf(os.Stderr, "save $%04x-$%04x, size=%d\n", start, end, size)
+
+	data := make([]Byte, size)
+	for n := Word(0); n < size; n++ {
+		data[n] = p.bus.Read(start + n)
+	}
+
+	switch {
+	case device == DEVICE_TAPE1 || device == DEVICE_TAPE2:
+		filename, err := p.tapeFile(name, true)
+		if errors.Is(err, dialog.Cancelled) {
+			return KERNAL_OK
+		}
+		if err == nil {
+			err = p.cassette.Save(filename, start, size, data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "save: %s\n", err)
+			return KERNAL_NOT_OUTPUT_FILE
+		}
+	case p.drive(device) != nil:
+		// Errors are reported on the drive's error channel
+		prg := Prg{}
+		prg.SetAddr(start)
+		prg.SetSize(size)
+		p.drive(device).SaveFile(name, prg.Save(data))
+	default:
+		return KERNAL_DEVICE_NOT_PRESENT
+	}
+	return KERNAL_OK
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Cycles the parallel printer holds its acknowledge line low
+const USERPORT_ACK_CYCLES = 5
+
+/*
+UserPortDevice is implemented by hardware plugged into the user port. The
+port has eight data lines, PA0-PA7 on VIA port A, & two handshake lines: CA1,
+an input to the PET, & CB2, an output. The data lines are open collector, so a
+line is low if either the PET or the device pulls it low.
+
+A device which drives CA1 is given a function to set it when it is created.
+*/
+type UserPortDevice interface {
+	// Read returns the state of the data lines driven by the device. Lines
+	// the device doesn't drive are high.
+	Read() Byte
+	// Write is called when the PET changes the data lines. Lines which are
+	// inputs to the PET are high.
+	Write(data Byte)
+	// CB2 is called when the PET changes the CB2 line
+	CB2(level bool)
+	// Tick advances the device by the given number of cycles
+	Tick(cycles int)
+}
+
+// UserPort connects a device to the user port lines of the VIA
+type UserPort struct {
+	Device UserPortDevice // Device plugged in, or nil
+	VIA    *VIA           // VIA the port is connected to
+
+	pins Byte // Data lines driven by the PET
+	cb2  bool // Last state of CB2
+}
+
+// NewUserPortDevice creates a device from a command line description, which is
+// the name of the device & any argument E.g. "printer:out.txt"
+func NewUserPortDevice(desc string, ca1 func(level bool)) (UserPortDevice, error) {
+	name, arg, _ := strings.Cut(desc, ":")
+	switch name {
+	case "printer":
+		if arg == "" {
+			return nil, fmt.Errorf("user port printer requires a filename E.g. printer:out.txt")
+		}
+		return NewUserPortPrinter(arg, ca1)
+	case "loopback":
+		return &UserPortLoopback{CA1: ca1}, nil
+	case "joystick":
+		return &UserPortJoystick{}, nil
+	}
+	return nil, fmt.Errorf("unknown user port device %q", name)
+}
+
+// Reset sets the lines to their state after the VIA is reset
+func (u *UserPort) Reset() {
+	u.pins = 0xff
+	u.cb2 = true
+	if u.Device != nil {
+		u.Device.Write(u.pins)
+	}
+}
+
+// Read returns the state of the data lines
+func (u *UserPort) Read() Byte {
+	if u.Device == nil {
+		return u.pins
+	}
+	return u.pins & u.Device.Read()
+}
+
+// Write sets the data lines driven by the PET
+func (u *UserPort) Write(data Byte) {
+	u.pins = data
+	if u.Device != nil {
+		u.Device.Write(data)
+	}
+}
+
+// Tick passes any change to CB2 to the device & advances it
+func (u *UserPort) Tick(cycles int) {
+	if u.Device == nil {
+		return
+	}
+	cb2 := u.VIA.CB2() != 0
+	if cb2 != u.cb2 {
+		u.cb2 = cb2
+		u.Device.CB2(cb2)
+	}
+	u.Device.Tick(cycles)
+}
+
+// Close closes the device, if it has anything to write back
+func (u *UserPort) Close() error {
+	if c, ok := u.Device.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+/*
+UserPortPrinter is a parallel (Centronics) printer adapter. The PET puts a
+byte on the data lines & pulses CB2 low to strobe it into the printer, which
+acknowledges it by pulsing CA1 low. Each byte is written to a file unchanged,
+as the printer would receive it.
+*/
+type UserPortPrinter struct {
+	CA1 func(level bool) // Sets the acknowledge line
+
+	file *os.File
+	out  *bufio.Writer
+	data Byte // Data lines
+	ack  int  // Cycles until acknowledge is released
+}
+
+// NewUserPortPrinter creates a printer which writes to a file
+func NewUserPortPrinter(filename string, ca1 func(level bool)) (*UserPortPrinter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &UserPortPrinter{
+		CA1:  ca1,
+		file: file,
+		out:  bufio.NewWriter(file),
+	}, nil
+}
+
+// Read returns high lines; the printer only drives the handshake
+func (p *UserPortPrinter) Read() Byte {
+	return 0xff
+}
+
+func (p *UserPortPrinter) Write(data Byte) {
+	p.data = data
+}
+
+// CB2 prints the data on the falling edge of the strobe
+func (p *UserPortPrinter) CB2(level bool) {
+	if level {
+		return
+	}
+	p.out.WriteByte(byte(p.data))
+	p.ack = USERPORT_ACK_CYCLES
+	p.CA1(false)
+}
+
+// Tick releases the acknowledge line
+func (p *UserPortPrinter) Tick(cycles int) {
+	if p.ack <= 0 {
+		return
+	}
+	p.ack -= cycles
+	if p.ack <= 0 {
+		p.CA1(true)
+	}
+}
+
+// Close writes anything printed to the file
+func (p *UserPortPrinter) Close() error {
+	err := p.out.Flush()
+	if err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+/*
+UserPortLoopback is a test plug which connects each of PA0-PA3 to the line
+four above it, PA4-PA7, & CB2 to CA1. A test sets one half of port A as outputs
+& reads them back on the other half, & toggles CB2 to check that CA1 sets its
+interrupt flag.
+*/
+type UserPortLoopback struct {
+	CA1 func(level bool) // Sets CA1
+
+	data Byte // Data lines driven by the PET
+}
+
+// Read returns each half of the data lines on the other half
+func (l *UserPortLoopback) Read() Byte {
+	return l.data<<4 | l.data>>4
+}
+
+func (l *UserPortLoopback) Write(data Byte) {
+	l.data = data
+}
+
+func (l *UserPortLoopback) CB2(level bool) {
+	l.CA1(level)
+}
+
+func (l *UserPortLoopback) Tick(cycles int) {
+}
@@ -1,22 +1,103 @@
 package main
 
+// VIA port numbers, for PortRead & PortWrite
+const (
+	VIA_PORTB = 0
+	VIA_PORTA = 1
+)
+
+// VIA interrupt flags
+const (
+	VIA_IRQ_CA2 = 0x01
+	VIA_IRQ_CA1 = 0x02
+	VIA_IRQ_SR  = 0x04
+	VIA_IRQ_CB2 = 0x08
+	VIA_IRQ_CB1 = 0x10
+	VIA_IRQ_T2  = 0x20
+	VIA_IRQ_T1  = 0x40
+	VIA_IRQ_ANY = 0x80
+)
+
+// VIA auxiliary control register bits
+const (
+	VIA_ACR_LATCH_A  = 0x01 // Port A input latching
+	VIA_ACR_LATCH_B  = 0x02 // Port B input latching
+	VIA_ACR_SR       = 0x1c // Shift register control
+	VIA_ACR_T2_COUNT = 0x20 // Timer 2 counts pulses on PB6
+	VIA_ACR_T1_FREE  = 0x40 // Timer 1 free-run
+	VIA_ACR_T1_PB7   = 0x80 // Timer 1 drives PB7
+)
+
+// VIA CA2/CB2 control modes (Peripheral control register bits 1-3 & 5-7)
+const (
+	VIA_C2_IN_NEG     = 0x0 // Input, negative active edge
+	VIA_C2_IN_NEG_IND = 0x1 // Independent interrupt input, negative edge
+	VIA_C2_IN_POS     = 0x2 // Input, positive active edge
+	VIA_C2_IN_POS_IND = 0x3 // Independent interrupt input, positive edge
+	VIA_C2_HANDSHAKE  = 0x4 // Handshake output
+	VIA_C2_PULSE      = 0x5 // Pulse output
+	VIA_C2_LOW        = 0x6 // Manual output, low
+	VIA_C2_HIGH       = 0x7 // Manual output, high
+)
+
 // VIA models a Versatile Interface Adaptor
 type VIA struct {
 	Base Word // Base address
 
+	PortRead  func(port int) Byte       // Read the input pins of a port
+	PortWrite func(port int, data Byte) // Notify a change to the output pins of a port
+
 	portAOut    Byte
 	portBOut    Byte
 	portADir    Byte
 	portBDir    Byte
+	portALatch  Byte
+	portBLatch  Byte
 	timer1      Word
 	timer1latch Word
 	timer2      Word
-	timer2latch Word
+	timer2latch Byte // Only the low byte of timer 2 is latched
+	shift       Byte
+	aux         Byte
 	peripheral  Byte
 	ifr         Byte
 	ie          Byte
+
+	timer1armed  bool // Timer 1 will interrupt on the next time-out
+	timer1reload bool // Timer 1 reloads from the latch on the next cycle
+	timer2armed  bool // Timer 2 will interrupt on the next time-out
+	pb7          bool // Timer 1 PB7 output
+	pb6          bool // Last state of PB6, for pulse counting
+
+	ca1 bool // Input line states
+	ca2 bool
+	cb1 bool
+	cb2 bool
+
+	ca2Out   bool // Output line states
+	cb2Out   bool
+	ca2Pulse bool // CA2 pulse output is active
+	cb2Pulse bool // CB2 pulse output is active
+
+	shiftActive bool // Shift register is shifting
+	shiftCount  int  // Number of bits shifted
+	shiftClock  bool // Shift register clock (CB1 output)
+	shiftTimer  Byte // Timer 2 low byte counter, for the shift rate
+	shiftReload bool // Shift timer reloads from the latch on the next cycle
 }
 
+// VIA shift register modes (Auxiliary control register bits 2-4)
+const (
+	VIA_SR_DISABLED = 0x0 // Disabled
+	VIA_SR_IN_T2    = 0x1 // Shift in under control of timer 2
+	VIA_SR_IN_PHI2  = 0x2 // Shift in under control of the system clock
+	VIA_SR_IN_CB1   = 0x3 // Shift in under control of an external clock
+	VIA_SR_OUT_FREE = 0x4 // Shift out free-running at the timer 2 rate
+	VIA_SR_OUT_T2   = 0x5 // Shift out under control of timer 2
+	VIA_SR_OUT_PHI2 = 0x6 // Shift out under control of the system clock
+	VIA_SR_OUT_CB1  = 0x7 // Shift out under control of an external clock
+)
+
 func (v *VIA) GetBase() Word {
 	return v.Base
 }
@@ -26,76 +107,442 @@ func (v *VIA) GetSize() Word {
 }
 
 func (v *VIA) CheckInterrupt() bool {
-	return false
+	return v.ifr&v.ie&0x7f != 0
+}
+
+// Reset the VIA as though RES had been asserted
+func (v *VIA) Reset() {
+	v.portAOut, v.portBOut = 0x00, 0x00
+	v.portADir, v.portBDir = 0x00, 0x00
+	v.aux, v.peripheral = 0x00, 0x00
+	v.ifr, v.ie = 0x00, 0x00
+	v.timer1armed, v.timer2armed = false, false
+	v.timer1reload = false
+	v.pb7 = true
+	v.ca1, v.ca2, v.cb1, v.cb2 = true, true, true, true
+	v.ca2Out, v.cb2Out = true, true
+	v.ca2Pulse, v.cb2Pulse = false, false
+	v.shiftActive, v.shiftCount = false, 0
+	v.shiftClock, v.shiftReload = false, false
+}
+
+// readPins returns the state of the input pins of a port. Unconnected pins
+// are pulled high.
+func (v *VIA) readPins(port int) Byte {
+	if v.PortRead == nil {
+		return 0xff
+	}
+	return v.PortRead(port)
+}
+
+// writePins notifies the new state of the output pins of a port. Pins which
+// are configured as inputs are pulled high.
+func (v *VIA) writePins(port int) {
+	if v.PortWrite == nil {
+		return
+	}
+	switch port {
+	case VIA_PORTA:
+		v.PortWrite(port, v.portAOut|^v.portADir)
+	case VIA_PORTB:
+		v.PortWrite(port, v.portBOut|^v.portBDir)
+	}
+}
+
+func (v *VIA) clearFlags(flags Byte) {
+	v.ifr &^= flags
+}
+
+// portB returns the value read from port B
+func (v *VIA) portB() Byte {
+	in := v.readPins(VIA_PORTB)
+	if v.aux&VIA_ACR_LATCH_B != 0 && v.ifr&VIA_IRQ_CB1 != 0 {
+		in = v.portBLatch
+	}
+	data := (in &^ v.portBDir) | (v.portBOut & v.portBDir)
+
+	// Timer 1 can drive PB7
+	if v.aux&VIA_ACR_T1_PB7 != 0 {
+		data &^= 0x80
+		if v.pb7 {
+			data |= 0x80
+		}
+	}
+	return data
+}
+
+// portA returns the value read from port A. Port A always reads the pins,
+// even when they are outputs
+func (v *VIA) portA() Byte {
+	if v.aux&VIA_ACR_LATCH_A != 0 && v.ifr&VIA_IRQ_CA1 != 0 {
+		return v.portALatch
+	}
+	return v.readPins(VIA_PORTA)
+}
+
+// accessPortA handles the side effects of reading or writing port A
+func (v *VIA) accessPortA() {
+	v.clearFlags(VIA_IRQ_CA1)
+	mode := (v.peripheral >> 1) & 0x07
+	if mode != VIA_C2_IN_NEG_IND && mode != VIA_C2_IN_POS_IND {
+		v.clearFlags(VIA_IRQ_CA2)
+	}
+
+	// Handshake & pulse modes take CA2 low
+	switch mode {
+	case VIA_C2_HANDSHAKE:
+		v.ca2Out = false
+	case VIA_C2_PULSE:
+		v.ca2Out = false
+		v.ca2Pulse = true
+	}
+}
+
+// accessPortB handles the side effects of reading or writing port B
+func (v *VIA) accessPortB(write bool) {
+	v.clearFlags(VIA_IRQ_CB1)
+	mode := (v.peripheral >> 5) & 0x07
+	if mode != VIA_C2_IN_NEG_IND && mode != VIA_C2_IN_POS_IND {
+		v.clearFlags(VIA_IRQ_CB2)
+	}
+
+	// Handshake & pulse modes take CB2 low, on write only
+	if write {
+		switch mode {
+		case VIA_C2_HANDSHAKE:
+			v.cb2Out = false
+		case VIA_C2_PULSE:
+			v.cb2Out = false
+			v.cb2Pulse = true
+		}
+	}
 }
 
 func (v *VIA) Read(address Word) Byte {
 	port := address - v.Base
 	switch port {
 	case 0x0: // Port B output
-		return v.portBOut
+		data := v.portB()
+		v.accessPortB(false)
+		return data
 	case 0x1: // Port A output
-		return v.portAOut
+		data := v.portA()
+		v.accessPortA()
+		return data
 	case 0x2: // Port B direction
 		return v.portBDir
 	case 0x3: // Port A direction
 		return v.portADir
 	case 0x4: // Timer 1 low
+		v.clearFlags(VIA_IRQ_T1)
+		return Byte(v.timer1 & 0xff)
 	case 0x5: // Timer 1 high
+		return Byte(v.timer1 >> 8)
 	case 0x6: // Timer 1 latch low
+		return Byte(v.timer1latch & 0xff)
 	case 0x7: // Timer 1 latch high
+		return Byte(v.timer1latch >> 8)
 	case 0x8: // Timer 2 low
+		v.clearFlags(VIA_IRQ_T2)
+		return Byte(v.timer2 & 0xff)
 	case 0x9: // Timer 2 high
-	case 0xa: // Timer 2 latch low
-	case 0xb: // Timer 2 latch high
+		return Byte(v.timer2 >> 8)
+	case 0xa: // Shift register
+		v.clearFlags(VIA_IRQ_SR)
+		v.startShift()
+		return v.shift
+	case 0xb: // Auxiliary control
+		return v.aux
 	case 0xc: // Peripheral control
 		return v.peripheral
 	case 0xd: // Interrupt flag register (IFR)
+		if v.CheckInterrupt() {
+			return v.ifr | VIA_IRQ_ANY
+		}
 		return v.ifr
 	case 0xe: // Interrupt enable register
-		return v.ie
+		return v.ie | 0x80
 	case 0xf: // IO Port A output, without handshaking
-		return v.portAOut
+		return v.portA()
 	default:
 		return Byte(0)
 	}
-
-	return Byte(0)
 }
 
 func (v *VIA) Write(address Word, data Byte) {
 	port := address - v.Base
 	switch port {
 	case 0x0: // Port B output
+		v.accessPortB(true)
 		v.portBOut = data
+		v.writePins(VIA_PORTB)
 	case 0x1: // Port A output
+		v.accessPortA()
 		v.portAOut = data
+		v.writePins(VIA_PORTA)
 	case 0x2: // Port B direction
 		v.portBDir = data
+		v.writePins(VIA_PORTB)
 	case 0x3: // Port A direction
 		v.portADir = data
-	case 0x4: // Timer 1 low
+		v.writePins(VIA_PORTA)
+	case 0x4, 0x6: // Timer 1 low, Timer 1 latch low
+		v.timer1latch = v.timer1latch&0xff00 | Word(data)
 	case 0x5: // Timer 1 high
-	case 0x6: // Timer 1 latch low
+		// Load the counter from the latch & start the timer
+		v.timer1latch = v.timer1latch&0x00ff | Word(data)<<8
+		v.timer1 = v.timer1latch
+		v.timer1armed = true
+		v.timer1reload = false
+		v.clearFlags(VIA_IRQ_T1)
+		if v.aux&VIA_ACR_T1_PB7 != 0 {
+			v.pb7 = false
+		}
 	case 0x7: // Timer 1 latch high
+		v.timer1latch = v.timer1latch&0x00ff | Word(data)<<8
+		v.clearFlags(VIA_IRQ_T1)
 	case 0x8: // Timer 2 low
+		v.timer2latch = data
 	case 0x9: // Timer 2 high
-	case 0xa: // Timer 2 latch low
-	case 0xb: // Timer 2 latch high
+		// Load the counter & start the timer
+		v.timer2 = Word(data)<<8 | Word(v.timer2latch)
+		v.timer2armed = true
+		v.clearFlags(VIA_IRQ_T2)
+	case 0xa: // Shift register
+		v.shift = data
+		v.clearFlags(VIA_IRQ_SR)
+		v.startShift()
+	case 0xb: // Auxiliary control
+		v.aux = data
 	case 0xc: // Peripheral control
 		v.peripheral = data
+		v.updateControlOutputs()
 	case 0xd: // Interrupt flag register (IFR)
-		v.ifr = data
+		// Writing a 1 clears the flag
+		v.clearFlags(data & 0x7f)
 	case 0xe: // Interrupt enable register
-		v.ie = data
+		// Bit 7 selects set or clear of the other bits
+		if data&0x80 != 0 {
+			v.ie |= data & 0x7f
+		} else {
+			v.ie &^= data & 0x7f
+		}
 	case 0xf: // IO Port A output, without handshaking
 		v.portAOut = data
+		v.writePins(VIA_PORTA)
+	}
+}
+
+// updateControlOutputs sets the CA2 & CB2 outputs when the control mode
+// changes. Inputs are pulled high.
+func (v *VIA) updateControlOutputs() {
+	v.ca2Out = (v.peripheral>>1)&0x07 != VIA_C2_LOW
+	v.cb2Out = (v.peripheral>>5)&0x07 != VIA_C2_LOW
+}
+
+// Tick advances the timers by the given number of clock cycles
+func (v *VIA) Tick(cycles int) {
+	for n := 0; n < cycles; n++ {
+		v.tick()
 	}
 }
 
+func (v *VIA) tick() {
+	// Pulse outputs last for a single cycle
+	if v.ca2Pulse {
+		v.ca2Pulse = false
+		v.ca2Out = true
+	}
+	if v.cb2Pulse {
+		v.cb2Pulse = false
+		v.cb2Out = true
+	}
+
+	// Timer 1
+	if v.timer1reload {
+		v.timer1 = v.timer1latch
+		v.timer1reload = false
+	} else {
+		v.timer1--
+		if v.timer1 == 0xffff {
+			free := v.aux&VIA_ACR_T1_FREE != 0
+			if v.timer1armed {
+				v.ifr |= VIA_IRQ_T1
+				if free {
+					v.pb7 = !v.pb7
+				} else {
+					v.pb7 = true
+					v.timer1armed = false
+				}
+			}
+			if free {
+				v.timer1reload = true
+			}
+		}
+	}
+
+	// The shift register may be clocked by timer 2 or the system clock
+	switch v.shiftMode() {
+	case VIA_SR_IN_T2, VIA_SR_OUT_FREE, VIA_SR_OUT_T2:
+		if v.shiftReload {
+			v.shiftTimer = v.timer2latch
+			v.shiftReload = false
+		} else {
+			v.shiftTimer--
+			if v.shiftTimer == 0xff {
+				v.shiftReload = true
+				v.clockShift()
+			}
+		}
+	case VIA_SR_IN_PHI2, VIA_SR_OUT_PHI2:
+		v.clockShift()
+	}
+
+	// Timer 2, either as a one-shot timer or counting pulses on PB6
+	if v.aux&VIA_ACR_T2_COUNT != 0 {
+		pb6 := v.readPins(VIA_PORTB)&0x40 != 0
+		if v.pb6 && !pb6 {
+			v.countTimer2()
+		}
+		v.pb6 = pb6
+	} else {
+		v.countTimer2()
+	}
+}
+
+func (v *VIA) countTimer2() {
+	v.timer2--
+	if v.timer2 == 0xffff && v.timer2armed {
+		v.ifr |= VIA_IRQ_T2
+		v.timer2armed = false
+	}
+}
+
+func (v *VIA) shiftMode() Byte {
+	return (v.aux & VIA_ACR_SR) >> 2
+}
+
+// startShift starts the shift register shifting 8 bits, after it is read or
+// written
+func (v *VIA) startShift() {
+	v.shiftActive = true
+	v.shiftCount = 0
+}
+
+// clockShift toggles the shift register clock. A bit is shifted on each
+// rising edge of the clock.
+func (v *VIA) clockShift() {
+	v.shiftClock = !v.shiftClock
+	if v.shiftClock {
+		v.shiftBit()
+	}
+}
+
+// shiftBit shifts a single bit in from, or out to, CB2
+func (v *VIA) shiftBit() {
+	mode := v.shiftMode()
+
+	// Free-running mode never stops
+	if !v.shiftActive && mode != VIA_SR_OUT_FREE {
+		return
+	}
+
+	if mode >= VIA_SR_OUT_FREE {
+		// Shift out on CB2, recirculating bit 7 into bit 0
+		bit := v.shift & 0x80
+		v.shift = v.shift<<1 | bit>>7
+		v.cb2Out = bit != 0
+	} else {
+		// Shift in from CB2
+		v.shift <<= 1
+		if v.cb2 {
+			v.shift |= 0x01
+		}
+	}
+
+	if mode != VIA_SR_OUT_FREE {
+		v.shiftCount++
+		if v.shiftCount == 8 {
+			v.shiftActive = false
+			v.ifr |= VIA_IRQ_SR
+		}
+	}
+}
+
+// activeEdge returns true if the change from old to new is the active edge
+func activeEdge(old, new, positive bool) bool {
+	if positive {
+		return !old && new
+	}
+	return old && !new
+}
+
+// CA1 sets the state of the CA1 input line
+func (v *VIA) CA1(level bool) {
+	if activeEdge(v.ca1, level, v.peripheral&0x01 != 0) {
+		v.ifr |= VIA_IRQ_CA1
+		v.portALatch = v.readPins(VIA_PORTA)
+
+		// The active edge completes a CA2 handshake
+		if (v.peripheral>>1)&0x07 == VIA_C2_HANDSHAKE {
+			v.ca2Out = true
+		}
+	}
+	v.ca1 = level
+}
+
+// CB1 sets the state of the CB1 input line
+func (v *VIA) CB1(level bool) {
+	// CB1 can be an external clock for the shift register
+	mode := v.shiftMode()
+	if (mode == VIA_SR_IN_CB1 || mode == VIA_SR_OUT_CB1) && !v.cb1 && level {
+		v.shiftBit()
+	}
+
+	if activeEdge(v.cb1, level, v.peripheral&0x10 != 0) {
+		v.ifr |= VIA_IRQ_CB1
+		v.portBLatch = v.readPins(VIA_PORTB)
+
+		// The active edge completes a CB2 handshake
+		if (v.peripheral>>5)&0x07 == VIA_C2_HANDSHAKE {
+			v.cb2Out = true
+		}
+	}
+	v.cb1 = level
+}
+
+// CA2In sets the state of the CA2 line, when it is an input
+func (v *VIA) CA2In(level bool) {
+	mode := (v.peripheral >> 1) & 0x07
+	if mode < VIA_C2_HANDSHAKE && activeEdge(v.ca2, level, mode&0x02 != 0) {
+		v.ifr |= VIA_IRQ_CA2
+	}
+	v.ca2 = level
+}
+
+// CB2In sets the state of the CB2 line, when it is an input
+func (v *VIA) CB2In(level bool) {
+	mode := (v.peripheral >> 5) & 0x07
+	if mode < VIA_C2_HANDSHAKE && activeEdge(v.cb2, level, mode&0x02 != 0) {
+		v.ifr |= VIA_IRQ_CB2
+	}
+	v.cb2 = level
+}
+
 // Additional helper functions for exposing specific lines
 
-// Return the current state of the CB2 line (Peripheral Control Register bit 2)
+// Return the current state of the CA2 output line
+func (v *VIA) CA2() Byte {
+	if v.ca2Out {
+		return 1
+	}
+	return 0
+}
+
+// Return the current state of the CB2 output line
 func (v *VIA) CB2() Byte {
-	return Byte((v.peripheral & 0x02) >> 1)
+	if v.cb2Out {
+		return 1
+	}
+	return 0
 }
@@ -1,63 +1,380 @@
 package main
 
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
 const (
 	scr_w      = 40
 	scr_h      = 25
+	char_h     = 8
+	pitch_x    = 10
+	pitch_y    = 10
 	borderTop  = 30
 	borderLeft = 40
 	VID_MEM    = 0x8000
+	VID_MASK   = 0x03ff
+)
+
+// Video timing of PETs without a CRTC, which is fixed at 60 Hz
+const (
+	VIDEO_LINE_CYCLES = 64  // Cycles in each scan line
+	VIDEO_LINES       = 260 // Scan lines in each frame
+	VIDEO_SYNC_LINES  = 16  // CRTC vertical sync width, when the register holds 0
 )
 
 type Video struct {
 	Read    func(address Word) Byte // Read a single byte from the bus
-	VIA_CB2 func() Byte             // Returns the current status of the VIA CB2 line
+	VIA_CA2 func() Byte             // Returns the current status of the VIA CA2 line
 	PIA_CB1 func(bool)              // Notify PIA of retrace via. the CB1 line
 
-	ROM *ROM // Character generator ROM
+	Charset *ROM         // Character generator ROM, replaced to change the character set
+	CRTC    *CRTC        // CRT controller, if fitted
+	Wide    bool         // 80 column hardware: two characters per CRTC character clock
+	Frames  *FrameBuffer // Completed frames, for the GUI
+	OnFrame func(*Frame) // Called with each completed frame, or nil
+
+	cycle   int   // Cycles since the start of the frame
+	retrace bool  // The vertical drive signal is in retrace
+	frame   Frame // Last completed frame
 }
 
-func (v *Video) Redraw(drawPixel func(x, y int)) {
-	// Start retrace interrupt
-	v.PIA_CB1(true)
+/*
+timing returns the number of cycles in each frame, & the cycles from the start
+of the frame to the start & end of vertical retrace. The frame starts with the
+first displayed scan line.
 
-	// Draw 40 x 25 characters
-	var scr_y, scr_x int
+Without a CRTC the PET displays 200 of 260 scan lines of 64 cycles, at 60 Hz,
+& the vertical drive signal is in retrace for the rest of the frame. The CRTC
+clocks a character (or a pair, for 80 columns) every cycle, so its frame rate
+follows the registers, which the editor ROM sets for 50 or 60 Hz, & retrace is
+the vertical sync pulse.
+*/
+func (v *Video) timing() (frame, start, end int) {
+	if v.CRTC == nil {
+		return VIDEO_LINES * VIDEO_LINE_CYCLES, scr_h * char_h * VIDEO_LINE_CYCLES, VIDEO_LINES * VIDEO_LINE_CYCLES
+	}
+
+	line := v.CRTC.HorizontalTotal()
+	sync := v.CRTC.VerticalSync() * v.CRTC.CharHeight()
+	width := v.CRTC.VerticalSyncWidth()
+	if width == 0 {
+		width = VIDEO_SYNC_LINES
+	}
+	return v.CRTC.VerticalTotal() * line, sync * line, (sync + width) * line
+}
+
+// Tick advances the video by the given number of cycles, & sets the vertical
+// drive signal on PIA1 CB1. The falling edge at the start of retrace is the
+// 50 or 60 Hz interrupt, which runs the jiffy clock & the keyboard scan.
+func (v *Video) Tick(cycles int) {
+	frame, start, end := v.timing()
+	v.cycle += cycles
+	for v.cycle >= frame {
+		v.cycle -= frame
+	}
 
-	var line [scr_w]Byte
-	for y := int32(borderTop); scr_y < scr_h; y += 10 {
-		y_addr := Word(VID_MEM + (scr_y * scr_w))
-		// read 40 characters for the row
-		for n := range line {
-			line[n] = v.Read(y_addr + Word(n))
+	retrace := v.cycle >= start && v.cycle < end
+	if retrace != v.retrace {
+		v.retrace = retrace
+		v.PIA_CB1(!retrace)
+		if retrace {
+			v.capture()
 		}
+	}
+}
 
-		// For each row, draw 8 scanlines of 25 characters
-		for l := int32(0); l < 8; l++ {
-			scr_x = 0
-			for x := int32(borderLeft); scr_x < scr_w; x += 10 {
-				char := line[scr_x]
+// Retrace returns true during vertical retrace, when the screen can be written
+// without snow
+func (v *Video) Retrace() bool {
+	return v.retrace
+}
 
-				// If high bit of vmem is set, invert the video
-				invert := char & 0x80
+// Columns returns the number of characters displayed on each row
+func (v *Video) Columns() int {
+	if v.CRTC == nil {
+		return scr_w
+	}
+	if v.Wide {
+		return v.CRTC.Columns() * 2
+	}
+	return v.CRTC.Columns()
+}
 
-				romAddr := Word(char&0x7f)<<3 | Word(l&0x07)
-				// If VIA CB2 is set, set the high bit (A10) of the video ROM address
-				if v.VIA_CB2() != 0 {
-					romAddr |= 0x400
-				}
-				bits := v.ROM.Read(romAddr)
+// Rows returns the number of character rows displayed
+func (v *Video) Rows() int {
+	if v.CRTC == nil {
+		return scr_h
+	}
+	return v.CRTC.Rows()
+}
+
+// CharHeight returns the number of scan lines in each character row
+func (v *Video) CharHeight() int {
+	if v.CRTC == nil {
+		return char_h
+	}
+	return v.CRTC.CharHeight()
+}
+
+// rowPitch returns the distance between character rows, in pixels
+func rowPitch(charHeight int) int {
+	if h := charHeight + 2; h > pitch_y {
+		return h
+	}
+	return pitch_y
+}
+
+// Size returns the width & height of the display, in pixels
+func (v *Video) Size() (int, int) {
+	return borderLeft*2 + v.Columns()*pitch_x, borderTop*2 + v.Rows()*rowPitch(v.CharHeight())
+}
+
+// address returns the screen memory address of the character at the given
+// row & column
+func (v *Video) address(row, col int) Word {
+	if v.CRTC == nil {
+		return Word(VID_MEM + (row * scr_w) + col)
+	}
+
+	ma := v.CRTC.StartAddress() + Word(row*v.CRTC.Columns())
+	if v.Wide {
+		// Each character clock fetches an even & odd pair of characters
+		ma += Word(col / 2)
+		return VID_MEM + ((ma&VID_MASK)<<1 | Word(col&1))
+	}
+	ma += Word(col)
+	return VID_MEM + (ma & VID_MASK)
+}
+
+// capture copies the frame which has just been displayed, & passes it to the
+// frame buffer
+func (v *Video) capture() {
+	f := &v.frame
+	v.read(f)
+	f.Cycles, _, _ = v.timing()
+	f.Number++
+
+	if v.OnFrame != nil {
+		v.OnFrame(f)
+	}
+
+	if v.Frames == nil {
+		return
+	}
+	back := v.Frames.Back()
+	if back == nil {
+		// The GUI holds both frames
+		return
+	}
+	f.CopyTo(back)
+	v.Frames.Publish(back)
+}
+
+// read sets a frame from the screen memory & video configuration
+func (v *Video) read(f *Frame) {
+	f.Columns = v.Columns()
+	f.Rows = v.Rows()
+	f.CharHeight = v.CharHeight()
+	f.Screen = f.Screen[:0]
+	for row := 0; row < f.Rows; row++ {
+		for col := 0; col < f.Columns; col++ {
+			f.Screen = append(f.Screen, v.Read(v.address(row, col)))
+		}
+	}
+	// VIA CA2 sets the high bit (A10) of the character ROM address
+	f.Lower = v.VIA_CA2() != 0
+	f.Inverted = v.CRTC != nil && v.CRTC.Inverted()
+	f.Charset = v.Charset
+}
+
+// Frame returns the last completed frame. It is only valid until the next
+// frame completes.
+func (v *Video) Frame() *Frame {
+	return &v.frame
+}
+
+// Frame is a completed frame of the display
+type Frame struct {
+	Columns    int    // Characters on each row
+	Rows       int    // Character rows
+	CharHeight int    // Scan lines in each character row
+	Screen     []Byte // Screen codes, a row at a time
+	Lower      bool   // The lower case character set is selected
+	Inverted   bool   // The CRTC inverts the whole screen
+	Cycles     int    // Length of the frame, in cycles
+	Number     uint64 // Frames since the PET was started, counting from 1
+	Charset    *ROM   // Character generator ROM
+}
+
+// CopyTo copies the frame, reusing the screen of the destination
+func (f *Frame) CopyTo(dst *Frame) {
+	screen := append(dst.Screen[:0], f.Screen...)
+	*dst = *f
+	dst.Screen = screen
+}
+
+// Size returns the width & height of the frame, in pixels
+func (f *Frame) Size() (int, int) {
+	return borderLeft*2 + f.Columns*pitch_x, borderTop*2 + f.Rows*rowPitch(f.CharHeight)
+}
+
+/*
+Display draws frames as they appear on the PET's monitor, with the character
+ROM of each frame. It uses no other part of the PET, so the GUI & anything else
+which draws frames each have their own.
+*/
+type Display struct {
+	CRT *CRT // Appearance of the monitor
+
+	lit   *image.Gray // Pixels lit by the electron beam
+	shown Frame       // Last frame rendered
+}
+
+// Render draws a frame, & returns the image & the area which has changed.
+// Only the character rows which differ from the last frame rendered are
+// drawn, unless the size, character ROM, character set or inversion has
+// changed.
+func (d *Display) Render(f *Frame) (*image.RGBA, image.Rectangle) {
+	width, height := f.Size()
+	full := d.lit == nil || d.lit.Rect.Dx() != width || d.lit.Rect.Dy() != height ||
+		f.Columns != d.shown.Columns || f.Rows != d.shown.Rows || f.CharHeight != d.shown.CharHeight ||
+		f.Lower != d.shown.Lower || f.Inverted != d.shown.Inverted || f.Charset != d.shown.Charset
+	if full {
+		d.lit = image.NewGray(image.Rect(0, 0, width, height))
+	}
+
+	dirty := image.Rectangle{}
+	pitchY := rowPitch(f.CharHeight)
+	for row := 0; row < f.Rows; row++ {
+		line := f.Screen[row*f.Columns : (row+1)*f.Columns]
+		if !full && sameRow(line, d.shown.Screen[row*f.Columns:(row+1)*f.Columns]) {
+			continue
+		}
+		y := borderTop + row*pitchY
+		d.drawRow(f, line, y)
+		dirty = dirty.Union(image.Rect(0, y, width, y+pitchY))
+	}
+	if full {
+		dirty = d.lit.Rect
+	}
+
+	// Remember the frame, to compare with the next
+	frames := int(f.Number - d.shown.Number)
+	f.CopyTo(&d.shown)
+
+	return d.CRT.Draw(d.lit, dirty, frames)
+}
+
+// drawRow draws a row of characters with the character ROM, with the top at
+// the given scan line of the framebuffer
+func (d *Display) drawRow(f *Frame, line []Byte, y int) {
+	img := d.lit
+	draw.Draw(img, image.Rect(0, y, img.Rect.Dx(), y+rowPitch(f.CharHeight)), image.Black, image.Point{}, draw.Src)
+
+	// The CRTC can invert the entire screen
+	screenInvert := Byte(0)
+	if f.Inverted {
+		screenInvert = 0x80
+	}
+
+	// Draw 8 scanlines of characters. Any additional scanlines configured by
+	// the CRTC are blank
+	for l := 0; l < char_h && l < f.CharHeight; l++ {
+		for col, char := range line {
+			x := borderLeft + col*pitch_x
 
-				for p := int32(0); p < 8; p++ {
-					if (bits<<p)&0x80 != invert {
-						drawPixel(int(x+p+1), int(y+l+1))
-					}
+			// If high bit of vmem is set, invert the video
+			invert := (char & 0x80) ^ screenInvert
+
+			romAddr := Word(char&0x7f)<<3 | Word(l&0x07)
+			if f.Lower {
+				romAddr |= 0x400
+			}
+			bits := f.Charset.Read(romAddr)
+
+			for p := 0; p < 8; p++ {
+				if (bits<<p)&0x80 != invert {
+					img.SetGray(x+p+1, y+l+1, color.Gray{Y: 0xff})
 				}
-				scr_x++
 			}
 		}
-		scr_y++
 	}
+}
+
+// sameRow returns true if two rows of screen codes are the same
+func sameRow(a, b []Byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n] != b[n] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+FrameBuffer passes completed frames from the emulation to the GUI, so that the
+GUI never reads memory or devices which the CPU is changing. There are two
+frames: the GUI draws the front frame while the video fills the back frame.
+Frames are passed over channels, so each is only used by one side at a time.
+
+A completed frame which the GUI hasn't taken yet is replaced by the next one,
+& the video skips a frame if the GUI holds both, so neither side waits for the
+other.
+*/
+type FrameBuffer struct {
+	ready chan *Frame // Completed frame, waiting for the GUI
+	free  chan *Frame // Frames the GUI has finished with
+	front *Frame      // Frame the GUI is drawing; used by the GUI only
+}
 
-	// End retrace interrupt
-	v.PIA_CB1(false)
+func NewFrameBuffer() *FrameBuffer {
+	b := &FrameBuffer{
+		ready: make(chan *Frame, 1),
+		free:  make(chan *Frame, 2),
+	}
+	b.free <- &Frame{}
+	b.free <- &Frame{}
+	return b
+}
+
+// Back returns a frame for the video to fill, or nil if there is none
+func (b *FrameBuffer) Back() *Frame {
+	// Replace a frame the GUI hasn't taken
+	select {
+	case f := <-b.ready:
+		return f
+	default:
+	}
+	select {
+	case f := <-b.free:
+		return f
+	default:
+		return nil
+	}
+}
+
+// Publish passes a completed frame to the GUI. The ready channel is empty, as
+// only Back takes from it on this side.
+func (b *FrameBuffer) Publish(f *Frame) {
+	b.ready <- f
+}
+
+// Front returns the latest completed frame, for the GUI, or nil if there
+// hasn't been one. The frame which it replaces is returned to the video.
+func (b *FrameBuffer) Front() *Frame {
+	select {
+	case f := <-b.ready:
+		if b.front != nil {
+			b.free <- b.front
+		}
+		b.front = f
+	default:
+	}
+	return b.front
 }
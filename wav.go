@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+const (
+	wavHeaderSize = 44
+	wavFormatPCM  = 1
+)
+
+// WAVWriter writes mono 16bit PCM audio to a WAV file
+type WAVWriter struct {
+	file *os.File
+	rate int
+	size int // Size of the sample data, in bytes
+}
+
+// CreateWAV creates a WAV file with the given sample rate
+func CreateWAV(filename string, rate int) (*WAVWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAVWriter{
+		file: file,
+		rate: rate,
+	}
+
+	// The header is rewritten with the correct sizes on Close
+	err = w.writeHeader()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAVWriter) writeHeader() error {
+	header := make([]byte, wavHeaderSize)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+w.size))
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(header[20:], wavFormatPCM)
+	binary.LittleEndian.PutUint16(header[22:], 1) // channels
+	binary.LittleEndian.PutUint32(header[24:], uint32(w.rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(w.rate*2)) // byte rate
+	binary.LittleEndian.PutUint16(header[32:], 2)                // block align
+	binary.LittleEndian.PutUint16(header[34:], 16)               // bits per sample
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(w.size))
+
+	_, err := w.file.WriteAt(header, 0)
+	return err
+}
+
+// WriteSamples appends samples to the file
+func (w *WAVWriter) WriteSamples(samples []int16) error {
+	data := make([]byte, len(samples)*2)
+	for n, s := range samples {
+		binary.LittleEndian.PutUint16(data[n*2:], uint16(s))
+	}
+
+	_, err := w.file.WriteAt(data, int64(wavHeaderSize+w.size))
+	if err != nil {
+		return err
+	}
+	w.size += len(data)
+	return nil
+}
+
+// Close updates the header & closes the file
+func (w *WAVWriter) Close() error {
+	err := w.writeHeader()
+	if err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
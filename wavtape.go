@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Tape pulse timing
+const (
+	TAPE_SHORT_PULSE = 328 // Length of a leader pulse written by the kernal, in cycles
+	TAPE_LEADER      = 256 // Pulses used to measure the speed of a recording
+)
+
+// Default WAV decoding options
+const (
+	WAV_THRESHOLD = 0.05 // Fraction of full scale
+	WAV_TOLERANCE = 0.10 // Fraction of the nominal speed
+)
+
+// Sample levels of an exported tape, as 16bit PCM
+const (
+	WAV_TAPE_HIGH = 24000
+	WAV_TAPE_LOW  = -24000
+)
+
+/*
+WAVTapeOptions controls how a recording of a real tape is turned into pulses.
+The signal is squared up with a Schmitt trigger, which switches when it passes
+Threshold either side of the average level, so that noise around the zero
+crossings doesn't add extra pulses. A pulse starts at each falling edge, or
+each rising edge if Invert is set.
+
+Tapes recorded on a different machine, or played on a different deck, often
+run slightly fast or slow. The speed is measured from the leader at the start
+of the tape, & if it is within Tolerance of the nominal speed every pulse is
+adjusted to match.
+*/
+type WAVTapeOptions struct {
+	Threshold float64 // Switching level, as a fraction of full scale
+	Tolerance float64 // Largest speed correction, as a fraction; 0 disables it
+	Invert    bool    // Pulses start on a rising edge
+}
+
+// IsWAV returns true if the data looks like a WAV file
+func IsWAV(data []byte) bool {
+	return len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WAVE"
+}
+
+// readWAV returns the first channel of a PCM WAV file, scaled to -1..1, & the
+// sample rate
+func readWAV(data []byte) ([]float64, int, error) {
+	if !IsWAV(data) {
+		return nil, 0, errors.New("not a WAV file")
+	}
+
+	var (
+		channels, bits int
+		rate           int
+		samples        []byte
+	)
+	for chunk := data[12:]; len(chunk) >= 8; {
+		id := string(chunk[0:4])
+		size := int(binary.LittleEndian.Uint32(chunk[4:]))
+		body := chunk[8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, 0, errors.New("invalid WAV format")
+			}
+			if binary.LittleEndian.Uint16(body[0:]) != wavFormatPCM {
+				return nil, 0, errors.New("only PCM WAV files are supported")
+			}
+			channels = int(binary.LittleEndian.Uint16(body[2:]))
+			rate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+		case "data":
+			samples = body
+		}
+
+		// Chunks are padded to an even size
+		size += size & 1
+		if 8+size > len(chunk) {
+			break
+		}
+		chunk = chunk[8+size:]
+	}
+	if rate == 0 || channels == 0 || samples == nil {
+		return nil, 0, errors.New("invalid WAV file")
+	}
+	if bits != 8 && bits != 16 {
+		return nil, 0, fmt.Errorf("%d bit WAV files are not supported", bits)
+	}
+
+	frame := channels * bits / 8
+	out := make([]float64, len(samples)/frame)
+	for n := range out {
+		if bits == 8 {
+			out[n] = (float64(samples[n*frame]) - 128) / 128
+		} else {
+			out[n] = float64(int16(binary.LittleEndian.Uint16(samples[n*frame:]))) / 32768
+		}
+	}
+	return out, rate, nil
+}
+
+// decodeTapeWAV returns the pulses in a recording of a tape
+func decodeTapeWAV(data []byte, opts WAVTapeOptions) ([]uint32, error) {
+	samples, rate, err := readWAV(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return []uint32{}, nil
+	}
+
+	// Remove any DC offset
+	mean := 0.0
+	for _, s := range samples {
+		mean += s
+	}
+	mean /= float64(len(samples))
+
+	pulses := []uint32{}
+	high := samples[0] > mean
+	last := -1 // Sample at the start of the current pulse
+	for n, s := range samples {
+		s -= mean
+		if opts.Invert {
+			s = -s
+		}
+		switch {
+		case high && s < -opts.Threshold:
+			high = false
+			if last >= 0 {
+				pulses = append(pulses, uint32(float64(n-last)*CPU_CLOCK/float64(rate)))
+			}
+			last = n
+		case !high && s > opts.Threshold:
+			high = true
+		}
+	}
+
+	if opts.Tolerance > 0 {
+		adjustSpeed(pulses, opts.Tolerance)
+	}
+	return pulses, nil
+}
+
+// adjustSpeed scales the pulses so that the leader runs at the nominal speed,
+// if it is close enough
+func adjustSpeed(pulses []uint32, tolerance float64) {
+	if len(pulses) < TAPE_LEADER {
+		return
+	}
+
+	// The median of the first pulses ignores any noise before the leader
+	leader := append([]uint32{}, pulses[:TAPE_LEADER]...)
+	sort.Slice(leader, func(i, j int) bool {
+		return leader[i] < leader[j]
+	})
+	speed := float64(TAPE_SHORT_PULSE) / float64(leader[len(leader)/2])
+	if speed < 1-tolerance || speed > 1+tolerance {
+		return
+	}
+	for n, p := range pulses {
+		pulses[n] = uint32(float64(p)*speed + 0.5)
+	}
+}
+
+// writeTapeWAV writes pulses as a square wave which a real PET can load.
+// Each pulse is low for the first half & high for the second.
+func writeTapeWAV(filename string, pulses []uint32) error {
+	w, err := CreateWAV(filename, SAMPLE_RATE)
+	if err != nil {
+		return err
+	}
+
+	samples := []int16{}
+	clock := 0.0 // Position in the recording, in samples
+	written := 0 // Samples generated
+	level := func(until float64, s int16) {
+		for ; float64(written) < until; written++ {
+			samples = append(samples, s)
+		}
+	}
+	for _, p := range pulses {
+		half := float64(p/2) * SAMPLE_RATE / CPU_CLOCK
+		clock += half
+		level(clock, WAV_TAPE_LOW)
+		clock += float64(p)*SAMPLE_RATE/CPU_CLOCK - half
+		level(clock, WAV_TAPE_HIGH)
+
+		if len(samples) >= soundBufferSize {
+			err = w.WriteSamples(samples)
+			if err != nil {
+				w.Close()
+				return err
+			}
+			samples = samples[:0]
+		}
+	}
+
+	err = w.WriteSamples(samples)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}